@@ -0,0 +1,71 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import "sync"
+
+// keyAlloc holds a key together with its latch so a new key is a single allocation, its first state is part of the key
+type keyAlloc struct {
+	key   Key
+	latch sync.Mutex
+}
+
+// newKey returns an empty key for k
+func newKey(k []byte) *Key {
+	a := &keyAlloc{}
+	a.key.K = k
+	a.key.size = int64(len(k))
+	a.key.Latch = &a.latch
+	return &a.key
+}
+
+// newNode returns a node holding key, reusing a reclaimed node if one is available
+func (bst *BST) newNode(key *Key) *Node {
+	if node, ok := bst.reclaim.pool.Get().(*Node); ok {
+		node.Key = key
+		return node
+	}
+	return &Node{Key: key}
+}
+
+// releaseNode clears a node no longer reachable from the tree and pools it for reuse
+func (bst *BST) releaseNode(node *Node) {
+	*node = Node{}
+	bst.reclaim.pool.Put(node)
+}
+
+// operationPool holds applied operations for reuse by Put
+var operationPool = sync.Pool{
+	New: func() interface{} {
+		return new(Operation)
+	},
+}
+
+// newOperation returns a pooled operation which is released once the background writer applies it
+func newOperation(typ OperationType, key, value []byte, expires int64) *Operation {
+	op := operationPool.Get().(*Operation)
+	*op = Operation{Type: typ, Key: key, Value: value, Expires: expires, pooled: true}
+	return op
+}
+
+// releaseOperation returns an operation taken from the pool once it has been applied or dropped
+func releaseOperation(op *Operation) {
+	if op.pooled {
+		*op = Operation{}
+		operationPool.Put(op)
+	}
+}
@@ -0,0 +1,155 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBST_PutOffQueueAllocs(t *testing.T) {
+	bst := New(WithValueMode(ValueMap), WithZeroCopy())
+
+	defer func() {
+		bst.Close()
+	}()
+
+	key, value := []byte("key"), []byte("value")
+	bst.PutOffQueue(key, value)
+
+	// Updating an existing key builds no node, only the state publishing its new value
+	if allocs := testing.AllocsPerRun(100, func() {
+		bst.PutOffQueue(key, value)
+	}); allocs > 1 {
+		t.Fatalf("expected at most 1 allocation putting an existing key, got %v", allocs)
+	}
+
+	// A new key takes one allocation for the key and one for its node
+	keys := benchmarkKeys(101)
+	i := 0
+	if allocs := testing.AllocsPerRun(100, func() {
+		bst.PutOffQueue(keys[i], value)
+		i++
+	}); allocs > 2 {
+		t.Fatalf("expected at most 2 allocations putting a new key, got %v", allocs)
+	}
+
+	if bst.Get(keys[50]) == nil {
+		t.Fatal("expected key to be put")
+	}
+}
+
+func TestBST_NodeReuse(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.PutOffQueue([]byte("key"), []byte("value"))
+	bst.PutOffQueue([]byte("key2"), []byte("value"))
+	bst.deleteKey([]byte("key2"), nil)
+
+	// The recycled node must not carry the deleted key or its children
+	bst.PutOffQueue([]byte("key3"), []byte("value 3"))
+
+	key := bst.Get([]byte("key3"))
+	if key == nil || len(key.Values) != 1 || string(key.Values[0]) != "value 3" {
+		t.Fatalf("expected key3 to hold value 3, got %v", key)
+	}
+
+	if bst.Get([]byte("key2")) != nil {
+		t.Fatal("expected key2 to be deleted")
+	}
+
+	if keys := bst.Range([]byte("key"), []byte("key9")); len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(keys))
+	}
+}
+
+// benchmarkKeys returns n distinct keys
+func benchmarkKeys(n int) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%08d", (i*7919)%n))
+	}
+	return keys
+}
+
+func BenchmarkBST_PutOffQueueNewKey(b *testing.B) {
+	bst := New()
+	defer bst.Close()
+
+	keys := benchmarkKeys(b.N)
+	value := []byte("value")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bst.PutOffQueue(keys[i], value)
+	}
+}
+
+func BenchmarkBST_PutOffQueueExistingKey(b *testing.B) {
+	bst := New(WithValueMode(ValueMap))
+	defer bst.Close()
+
+	keys := benchmarkKeys(1024)
+	value := []byte("value")
+	for _, key := range keys {
+		bst.PutOffQueue(key, value)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bst.PutOffQueue(keys[i%len(keys)], value)
+	}
+}
+
+func BenchmarkBST_PutExistingKey(b *testing.B) {
+	bst := New(WithValueMode(ValueMap))
+	defer bst.Close()
+
+	keys := benchmarkKeys(1024)
+	value := []byte("value")
+	for _, key := range keys {
+		bst.PutOffQueue(key, value)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bst.Put(keys[i%len(keys)], value)
+	}
+}
+
+func BenchmarkBST_ReuseDeletedNodes(b *testing.B) {
+	bst := New()
+	defer bst.Close()
+
+	keys := benchmarkKeys(1024)
+	value := []byte("value")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := keys[i%len(keys)]
+		bst.PutOffQueue(key, value)
+		bst.deleteKey(key, nil)
+	}
+}
@@ -0,0 +1,307 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// DefaultArenaChunkSize is the default size of each arena chunk in bytes
+const DefaultArenaChunkSize = 1 << 20
+
+// Metric names reported by arena storage
+const (
+	MetricArenaBytes       = "bst_arena_bytes"             // Bytes stored within the arena, live or removed
+	MetricArenaCompactions = "bst_arena_compactions_total" // Compactions which moved live data to fresh chunks
+)
+
+// Arena is append only storage for keys and values.  Small slices are copied into large shared
+// chunks, so millions of keys and values take a few allocations instead of one each.  Keys refer to
+// their bytes and values by chunk index, offset and length rather than through slices, so the
+// garbage collector traces a handful of pointers per key however many values it holds.  Bytes are
+// never overwritten, slices handed out stay valid after compaction moves the tree off their chunk.
+type Arena struct {
+	ChunkSize  int              // Size of each chunk in bytes
+	lock       sync.Mutex       // Mutex for the current chunk and table
+	chunk      []byte           // Chunk being filled
+	current    uint32           // Index of the chunk being filled
+	table      unsafe.Pointer   // Chunks of the current generation, an *arenaTable
+	used       int64            // Bytes copied into the arena since it was created or last reset
+	compaction sync.Mutex       // Serializes compactions
+	grown      func(size int64) // Called with the arena's size after each copy, nil for none
+}
+
+// arenaRef locates bytes within a chunk of an arena
+type arenaRef struct {
+	chunk uint32 // Index of the chunk within its table
+	off   uint32 // Offset of the first byte within the chunk
+	len   uint32 // Number of bytes
+}
+
+// arenaTable is the chunks of one generation of an arena.  Adding a chunk publishes a new table
+// extending the last, a compaction starts a new generation with a table of its own.  A table is
+// never changed once published, so a key's state resolves its offsets through the table it was
+// built with while the arena moves on.
+type arenaTable struct {
+	arena  *Arena   // Arena the chunks belong to
+	chunks [][]byte // Chunks by index
+	gen    uint32   // Compactions of the arena before the generation started
+}
+
+// NewArena creates an arena allocating chunks of chunkSize bytes, DefaultArenaChunkSize if chunkSize is 0 or less
+func NewArena(chunkSize int) *Arena {
+	if chunkSize <= 0 {
+		chunkSize = DefaultArenaChunkSize
+	}
+
+	a := &Arena{ChunkSize: chunkSize}
+	a.table = unsafe.Pointer(&arenaTable{arena: a})
+	return a
+}
+
+// WithArena copies keys and values into an arena of chunkSize byte chunks, compacting it once
+// removed keys and values take up more than half of it
+func WithArena(chunkSize int) Option {
+	return func(bst *BST) {
+		bst.Arena = NewArena(chunkSize)
+		bst.Arena.grown = bst.arenaGrown
+		bst.setArenaCheck(0)
+	}
+}
+
+// Copy copies b into the arena.  Slices larger than a quarter of a chunk get their own allocation
+// so they do not waste the rest of a chunk.
+func (a *Arena) Copy(b []byte) []byte {
+	if len(b) == 0 {
+		return b[:0:0]
+	}
+
+	ref, t := a.put(b)
+	return t.bytes(ref)
+}
+
+// put copies b into the arena, returning where it was copied and a table holding its chunk
+func (a *Arena) put(b []byte) (arenaRef, *arenaTable) {
+	a.lock.Lock()
+	t := a.last()
+	if len(b) == 0 {
+		a.lock.Unlock()
+		return arenaRef{}, t
+	}
+
+	var ref arenaRef
+	if len(b) > a.ChunkSize/4 {
+		t = a.add(t, append(make([]byte, 0, len(b)), b...))
+		ref = arenaRef{chunk: uint32(len(t.chunks) - 1), len: uint32(len(b))}
+	} else {
+		if cap(a.chunk)-len(a.chunk) < len(b) {
+			a.chunk = make([]byte, 0, a.ChunkSize)
+			t = a.add(t, a.chunk)
+			a.current = uint32(len(t.chunks) - 1)
+		}
+
+		ref = arenaRef{chunk: a.current, off: uint32(len(a.chunk)), len: uint32(len(b))}
+		a.chunk = append(a.chunk, b...)
+	}
+
+	size := atomic.AddInt64(&a.used, int64(len(b)))
+	a.lock.Unlock()
+
+	if a.grown != nil {
+		a.grown(size)
+	}
+	return ref, t
+}
+
+// add publishes a table extending t with chunk, returning it.  The arena lock must be held.
+func (a *Arena) add(t *arenaTable, chunk []byte) *arenaTable {
+	// Older tables never index past their own length, so the new table may share their backing array
+	t = &arenaTable{arena: a, chunks: append(t.chunks, chunk), gen: t.gen}
+	atomic.StorePointer(&a.table, unsafe.Pointer(t))
+	return t
+}
+
+// last returns the table of the current generation holding every chunk added so far
+func (a *Arena) last() *arenaTable {
+	return (*arenaTable)(atomic.LoadPointer(&a.table))
+}
+
+// Size returns the bytes copied into the arena, including those of removed keys and values
+func (a *Arena) Size() int64 {
+	return atomic.LoadInt64(&a.used)
+}
+
+// reset starts a new generation of chunks so the current ones are released once no key's state refers to them
+func (a *Arena) reset() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.chunk = nil
+	atomic.StorePointer(&a.table, unsafe.Pointer(&arenaTable{arena: a, gen: a.last().gen + 1}))
+	atomic.StoreInt64(&a.used, 0)
+}
+
+// bytes returns the bytes at r, capped so appending to them can not overwrite their neighbours
+func (t *arenaTable) bytes(r arenaRef) []byte {
+	if r.len == 0 {
+		return nil
+	}
+
+	end := r.off + r.len
+	return t.chunks[r.chunk][r.off:end:end]
+}
+
+// store copies b into the arena for a state being built.  If a compaction has started a new generation
+// of chunks since the state's other bytes were copied, they are moved along so that a single table
+// resolves all of the state's offsets.
+func (s *keyState) store(b []byte) arenaRef {
+	if len(b) == 0 {
+		return arenaRef{}
+	}
+
+	for {
+		ref, t := s.table.arena.put(b)
+		if t.gen != s.table.gen {
+			s.moveTo(t)
+		}
+
+		if t.gen == s.table.gen {
+			// Tables of a generation only grow, the longer one resolves the offsets of both
+			if len(t.chunks) > len(s.table.chunks) {
+				s.table = t
+			}
+			return ref
+		}
+	}
+}
+
+// moveTo copies the key and values of a state being built into the chunks of t's generation
+func (s *keyState) moveTo(t *arenaTable) {
+	from := *s
+	s.table, s.key, s.refs = t, arenaRef{}, make([]arenaRef, 0, len(from.refs))
+
+	key := s.store(from.table.bytes(from.key))
+	s.key = key
+	for _, r := range from.refs {
+		ref := s.store(from.table.bytes(r))
+		s.refs = append(s.refs, ref)
+	}
+}
+
+// newKey returns an empty key for k as the tree stores it, with k copied into the arena if it has one.
+// k must be owned by the tree already.
+func (bst *BST) newKey(k []byte) *Key {
+	if bst.Arena == nil {
+		return newKey(k)
+	}
+
+	key := newKey(nil)
+	key.size = int64(len(k))
+
+	// The key is not linked yet, its first state is published as it is built
+	s := &key.first
+	s.table = bst.Arena.last()
+	s.key = s.store(k)
+	key.state = unsafe.Pointer(s)
+	return key
+}
+
+// arenaGrown checks for removed data in the background once the arena has doubled since the last check
+func (bst *BST) arenaGrown(size int64) {
+	bst.gauge(MetricArenaBytes, size)
+
+	if size >= atomic.LoadInt64(&bst.arenaCheck) && atomic.CompareAndSwapInt32(&bst.compacting, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&bst.compacting, 0)
+			bst.compact(false)
+		}()
+	}
+}
+
+// Compact moves the live keys and values to fresh arena chunks so chunks holding only removed data
+// are garbage collected, returning the bytes reclaimed.  It is a no-op without an arena.
+func (bst *BST) Compact() int64 {
+	if bst.Arena == nil {
+		return 0
+	}
+	return bst.compact(true)
+}
+
+// compact moves the live keys and values to fresh chunks if forced or if removed data takes up
+// more than half of the arena, returning the bytes reclaimed
+func (bst *BST) compact(force bool) int64 {
+	a := bst.Arena
+	a.compaction.Lock()
+	defer a.compaction.Unlock()
+
+	defer bst.unpin(bst.pin())
+
+	root := (*Node)(atomic.LoadPointer(&bst.Root))
+	used := a.Size()
+
+	var live int64
+	bst.walk(root, func(key *Key) bool {
+		live += int64(len(key.stored())) + key.load().size
+		return true
+	})
+
+	if !force && live > used/2 {
+		bst.setArenaCheck(used)
+		return 0
+	}
+
+	// Writes from here on go to a new generation of chunks, live data is moved across one key at a time
+	a.reset()
+	bst.walk(root, func(key *Key) bool {
+		key.Latch.Lock()
+		defer key.Latch.Unlock()
+
+		// Keys written since the reset already moved to the new generation
+		s := key.load()
+		if key.deleted || s.table.gen == a.last().gen {
+			return true
+		}
+
+		// Readers may hold the old state, publish a moved copy rather than changing it
+		n := key.next()
+		n.extend(s)
+		n.moveTo(a.last())
+		key.publish(n)
+		return true
+	})
+
+	size := a.Size()
+	bst.setArenaCheck(size)
+	bst.gauge(MetricArenaBytes, size)
+	bst.incr(MetricArenaCompactions, 1)
+
+	if used > size {
+		return used - size
+	}
+	return 0
+}
+
+// setArenaCheck schedules the next check for removed data once the arena has doubled from size
+func (bst *BST) setArenaCheck(size int64) {
+	check := 2 * size
+	if floor := int64(4 * bst.Arena.ChunkSize); check < floor {
+		check = floor
+	}
+	atomic.StoreInt64(&bst.arenaCheck, check)
+}
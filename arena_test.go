@@ -0,0 +1,224 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestArena_Copy(t *testing.T) {
+	arena := NewArena(64)
+
+	a := arena.Copy([]byte("aaaa"))
+	b := arena.Copy([]byte("bbbb"))
+
+	// Appending to a copy must not overwrite the next one within the chunk
+	a = append(a, 'x')
+	if string(b) != "bbbb" {
+		t.Fatalf("expected bbbb, got %s", b)
+	}
+
+	large := arena.Copy(bytes.Repeat([]byte("c"), 32))
+	if len(large) != 32 {
+		t.Fatalf("expected 32 bytes, got %d", len(large))
+	}
+
+	if arena.Size() != 40 {
+		t.Fatalf("expected 40 bytes stored, got %d", arena.Size())
+	}
+}
+
+func TestBST_Arena(t *testing.T) {
+	bst := New(WithArena(64))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bufs := make([][]byte, 10)
+	for i := range bufs {
+		bufs[i] = []byte(fmt.Sprintf("key%d", i))
+		bst.Put(bufs[i], bufs[i])
+	}
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	// The tree holds arena copies so changing the written buffers does not change its keys
+	for _, buf := range bufs {
+		copy(buf, "xxxx")
+	}
+
+	keys := bst.Range([]byte("key0"), []byte("key9"))
+	if len(keys) != 10 {
+		t.Fatalf("expected 10 keys, got %d", len(keys))
+	}
+
+	for i, key := range keys {
+		expect := fmt.Sprintf("key%d", i)
+		if string(key.K) != expect || string(key.Values[0]) != expect {
+			t.Fatalf("expected %s, got %s %s", expect, key.K, key.Values[0])
+		}
+	}
+}
+
+func TestBST_ArenaCompact(t *testing.T) {
+	bst := New(WithArena(64))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	for i := 0; i < 100; i++ {
+		bst.PutOffQueue([]byte(fmt.Sprintf("key%02d", i)), []byte("value"))
+	}
+
+	old := bst.Get([]byte("key05"))
+	for i := 0; i < 90; i++ {
+		bst.deleteKey([]byte(fmt.Sprintf("key%02d", i)), nil)
+	}
+
+	// 10 keys of 5 bytes with a 5 byte value remain
+	if reclaimed := bst.Compact(); reclaimed != 900 {
+		t.Fatalf("expected 900 bytes reclaimed, got %d", reclaimed)
+	}
+
+	if bst.Arena.Size() != 100 {
+		t.Fatalf("expected 100 bytes stored, got %d", bst.Arena.Size())
+	}
+
+	for i := 90; i < 100; i++ {
+		key := bst.Get([]byte(fmt.Sprintf("key%02d", i)))
+		if key == nil || string(key.Values[0]) != "value" {
+			t.Fatalf("expected key%02d to survive compaction", i)
+		}
+	}
+
+	// Slices handed out before compaction stay valid
+	if string(old.K) != "key05" || string(old.Values[0]) != "value" {
+		t.Fatalf("expected key05 to be unchanged, got %s", old.K)
+	}
+}
+
+func TestBST_ArenaAutoCompact(t *testing.T) {
+	registry := NewRegistry()
+	bst := New(WithArena(64), WithMetrics(registry))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	// Churn the same keys so removed data outgrows live data
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("key%02d", i))
+			bst.PutOffQueue(key, []byte("value"))
+			bst.deleteKey(key, nil)
+		}
+	}
+
+	// wait for the background compaction
+	time.Sleep(10 * time.Millisecond)
+
+	if registry.Counter(MetricArenaCompactions) == 0 {
+		t.Fatal("expected the arena to be compacted")
+	}
+
+	if bst.Arena.Size() >= 2000 {
+		t.Fatalf("expected removed data to be reclaimed, arena holds %d bytes", bst.Arena.Size())
+	}
+}
+
+func TestBST_ArenaOffsets(t *testing.T) {
+	bst := New(WithArena(64))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.PutOffQueue([]byte("key"), []byte("value"))
+	bst.PutOffQueue([]byte("key"), []byte("value 2"))
+
+	// The tree's own key refers to its bytes by offset rather than holding slices
+	key := bst.get((*Node)(atomic.LoadPointer(&bst.Root)), []byte("key"))
+	s := key.load()
+	if key.K != nil || s.values != nil || len(s.refs) != 2 {
+		t.Fatal("expected the key and its values to be held as arena offsets")
+	}
+
+	if string(key.bytes()) != "key" || string(s.value(1)) != "value 2" {
+		t.Fatalf("expected key and value 2, got %s %s", key.bytes(), s.value(1))
+	}
+}
+
+func TestBST_ArenaConcurrentCompact(t *testing.T) {
+	bst := New(WithArena(64), WithValueMode(ValueMap), WithPrefixCompression())
+
+	defer func() {
+		bst.Close()
+	}()
+
+	keys := make([][]byte, 50)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("compacted-key-%02d", i))
+		bst.PutOffQueue(keys[i], []byte("value"))
+	}
+
+	// Compact continuously while keys are read and rewritten
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				bst.Compact()
+			}
+		}
+	}()
+
+	for round := 0; round < 20; round++ {
+		value := []byte(fmt.Sprintf("value%02d", round))
+		for _, key := range keys {
+			bst.PutOffQueue(key, value)
+			if k := bst.Get(key); k == nil || !bytes.Equal(k.K, key) || !bytes.Equal(k.Values[0], value) {
+				t.Fatalf("expected %s to hold %s, got %v", key, value, k)
+			}
+		}
+
+		if n := len(bst.Range(keys[0], keys[len(keys)-1])); n != len(keys) {
+			t.Fatalf("expected %d keys, got %d", len(keys), n)
+		}
+	}
+
+	close(done)
+	wg.Wait()
+
+	// Only the last value of each key is left once compacted
+	bst.Compact()
+	if size := bst.Arena.Size(); size > int64(len(keys)*len("compacted-key-00value19")) {
+		t.Fatalf("expected removed values to be reclaimed, arena holds %d bytes", size)
+	}
+}
@@ -17,20 +17,61 @@
 package bst
 
 import (
-	"bytes"
+	"context"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
 // BST is the binary search tree struct
 type BST struct {
-	Root           unsafe.Pointer // Root of the binary search tree
-	WriteQueue     WriteQueue     // Incoming write queue
-	WriteQueueLock *sync.Mutex    // Mutex for the write queue
-	Exit           chan struct{}  // Exit channel
+	Root              unsafe.Pointer // Root of the binary search tree
+	WriteQueue        WriteQueue     // Incoming write queue, the queue of the first writer
+	WriteQueueLock    *sync.Mutex    // Mutex for the write queue
+	Exit              chan struct{}  // Exit channel
+	Wake              chan struct{}  // Signals the first background writer that writes are queued
+	Writers           int            // Number of background writers, writes are partitioned between them by key
+	Metrics           Metrics        // Instrumentation, nil when disabled
+	Encoding          Encoding       // Encoding of keys and values for JSON export, base64 when nil
+	ReapInterval      time.Duration  // Interval between sweeps for expired values
+	ValueMode         ValueMode      // How the values of a key are stored
+	MergeOperator     MergeOperator  // Operator combining values for Merge
+	MaxKeySize        int            // Largest key in bytes accepted by the Checked API, 0 for no limit
+	QueueCapacity     int            // Maximum writes waiting in the write queue, 0 for no limit
+	QueuePolicy       QueuePolicy    // How writes are handled while the write queue is full
+	Arena             *Arena         // Storage keys and values are copied into, nil to store them on the heap
+	ZeroCopy          bool           // Store the caller's key and value slices rather than copies
+	BorrowedReads     bool           // Return the tree's own keys from reads rather than copies
+	MaxBytes          int64          // Bytes of keys and values kept before evicting, 0 for no limit
+	MaxKeys           int64          // Keys kept before evicting, 0 for no limit
+	EvictionPolicy    EvictionPolicy // How keys are chosen for eviction
+	OnEvict           EvictFunc      // Called with each evicted key, nil for none
+	PrefixCompression bool           // Store keys relative to their parent's key when they share a prefix
+	Codec             Codec          // Compresses values larger than CompressThreshold, nil for none
+	CompressThreshold int            // Size in bytes above which values are compressed
+	Encryption        KeyProvider    // Keys sealing NDJSON exports with AES-GCM, nil to export plaintext
+	writers           []*writer      // Background writers, each with its own write queue
+	queued            int64          // Writes waiting across all write queues
+	nodes             int64          // Number of nodes within the tree
+	ttl               int32          // Set once a value with a TTL has been written
+	watchers          []*watcher     // Change feed subscribers
+	watchLock         sync.RWMutex   // Lock for the change feed subscribers
+	reclaim           reclaimer      // Epoch based reclamation of unlinked nodes
+	deleteLock        sync.Mutex     // Serializes unlinking so a node is never unlinked and retired twice
+	arenaCheck        int64          // Arena size at which to next check for removed data
+	compacting        int32          // Set while the arena is being compacted in the background
+	bytes             int64          // Bytes of keys and values within the tree
+	evictions         int64          // Keys evicted
+	evictedBytes      int64          // Bytes of keys and values evicted
+	evicting          int32          // Set while a writer is evicting keys
+	started           time.Time      // When the tree was created, access times are relative to it
+	compressed        compression    // Values compressed and their sizes
 }
 
+// Option configures a BST on New
+type Option func(*BST)
+
 // Node is a node within the binary search tree
 type Node struct {
 	Key   *Key           // Key of the node
@@ -39,124 +80,545 @@ type Node struct {
 	Latch sync.Mutex     // Mutex for this node, mainly for deletion
 }
 
+// left returns the node's left child.  Children are read and written atomically as readers
+// traverse the tree while writers link and unlink nodes.
+func (n *Node) left() *Node {
+	return (*Node)(atomic.LoadPointer(&n.Left))
+}
+
+// right returns the node's right child
+func (n *Node) right() *Node {
+	return (*Node)(atomic.LoadPointer(&n.Right))
+}
+
+// key returns the node's key.  A key is replaced when its node takes over the key of a deleted node's successor.
+func (n *Node) key() *Key {
+	return (*Key)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&n.Key))))
+}
+
+// setKey replaces the node's key
+func (n *Node) setKey(key *Key) {
+	atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&n.Key)), unsafe.Pointer(key))
+}
+
+// setLeft replaces the node's left child
+func (n *Node) setLeft(child *Node) {
+	atomic.StorePointer(&n.Left, unsafe.Pointer(child))
+}
+
+// setRight replaces the node's right child
+func (n *Node) setRight(child *Node) {
+	atomic.StorePointer(&n.Right, unsafe.Pointer(child))
+}
+
 // Key is the key for the binary search tree
 type Key struct {
-	K      []byte      // Key value
-	Values [][]byte    // Values within the key
-	Latch  *sync.Mutex // Key latch for changing values
+	K        []byte         // Key value, only the bytes after the shared prefix if compressed.  Held in the state with an arena.
+	Values   [][]byte       // Values of a key returned by a read, the tree's own keys hold theirs in their state
+	Expires  []int64        // Expiry of each value in unix nanoseconds, 0 for none, nil if no value expires
+	Latch    *sync.Mutex    // Key latch for changing values
+	state    unsafe.Pointer // Values as last published, nil until the first write.  Loaded without the latch.
+	first    keyState       // Storage for the key's first state, saving an allocation
+	deleted  bool           // Set once the key has been deleted, writers must retry from the root
+	size     int64          // Bytes of the key and its values
+	accessed int64          // When the key was last accessed, for eviction
+	hits     uint32         // Accesses since the key was created, halved by each eviction scan
+	prefix   []byte         // Bytes shared with the parent's key if compressed, nil otherwise.  Never changed once set.
+}
+
+// keyState is a key's values and their expiries as published to readers.  A state is never changed once
+// published, writers holding the key latch build a new one and publish it in its place, so readers load
+// a consistent snapshot of the values without the latch.  Values are only ever appended past the length
+// of a published state, which lets a new state share its predecessor's lists.  With an arena the state
+// holds the key and its values as offsets into the arena's chunks rather than as slices.
+type keyState struct {
+	values  [][]byte    // Values as stored, nil with an arena
+	refs    []arenaRef  // Values within the arena's chunks, in place of values with an arena
+	expires []int64     // Expiry of each value in unix nanoseconds, 0 for none, nil if no value expires
+	size    int64       // Bytes of the values
+	key     arenaRef    // Key within the arena's chunks, only the bytes after the shared prefix if compressed
+	table   *arenaTable // Chunks the offsets are resolved through, nil without an arena
+	one     [1][]byte   // Backing array of the first value, saving an allocation for a single value
 }
 
-// WriteQueue is a queue of write operations
+// noValues is the state of a key which has never been written
+var noValues keyState
+
+// load returns the key's values as last published
+func (k *Key) load() *keyState {
+	if s := (*keyState)(atomic.LoadPointer(&k.state)); s != nil {
+		return s
+	}
+	return &noValues
+}
+
+// next returns a state without values to build the key's next values in, the key's own storage for its
+// first.  The key latch must be held.
+func (k *Key) next() *keyState {
+	var n *keyState
+	if k.state == nil {
+		k.first = keyState{}
+		n = &k.first
+	} else {
+		n = &keyState{}
+	}
+
+	s := k.load()
+	n.key, n.table = s.key, s.table
+	return n
+}
+
+// publish replaces the key's values with s.  The key latch must be held.
+func (k *Key) publish(s *keyState) {
+	k.size += s.size - k.load().size
+	atomic.StorePointer(&k.state, unsafe.Pointer(s))
+}
+
+// appendValue appends a value which expires at expires, 0 for never.  The key latch must be held.
+func (k *Key) appendValue(value []byte, expires int64) {
+	n := k.next()
+	n.extend(k.load())
+	n.add(value, expires)
+	k.publish(n)
+}
+
+// removeValue removes the value at index i.  The key latch must be held.
+func (k *Key) removeValue(i int) {
+	s, n := k.load(), k.next()
+	n.copyFrom(s, 0, i)
+	n.copyFrom(s, i+1, s.len())
+	k.publish(n)
+}
+
+// len returns the number of values
+func (s *keyState) len() int {
+	if s.table != nil {
+		return len(s.refs)
+	}
+	return len(s.values)
+}
+
+// value returns the value at index i as stored
+func (s *keyState) value(i int) []byte {
+	if s.table != nil {
+		return s.table.bytes(s.refs[i])
+	}
+	return s.values[i]
+}
+
+// list returns the values as stored.  The list must not be changed, it belongs to the state without
+// an arena and is capped so appending to it copies rather than writing past it.
+func (s *keyState) list() [][]byte {
+	if s.table == nil {
+		return s.values[:len(s.values):len(s.values)]
+	}
+
+	if len(s.refs) == 0 {
+		return nil
+	}
+
+	values := make([][]byte, len(s.refs))
+	for i, r := range s.refs {
+		values[i] = s.table.bytes(r)
+	}
+	return values
+}
+
+// expiry returns the expiry of the value at index i, 0 if it never expires
+func (s *keyState) expiry(i int) int64 {
+	if s.expires == nil {
+		return 0
+	}
+	return s.expires[i]
+}
+
+// expired checks if the value at index i has expired at now
+func (s *keyState) expired(i int, now int64) bool {
+	e := s.expiry(i)
+	return e != 0 && e <= now
+}
+
+// extend takes the lists of from as they are for a state being built, values added afterwards go past
+// their length.  from must be the key's current state and s must be empty.
+func (s *keyState) extend(from *keyState) {
+	s.values, s.refs, s.expires, s.size = from.values, from.refs, from.expires, from.size
+}
+
+// add appends a value which expires at expires, 0 for never, to a state being built.  With an arena
+// the value is copied into it.
+func (s *keyState) add(value []byte, expires int64) {
+	if expires != 0 && s.expires == nil {
+		s.expires = make([]int64, s.len(), s.len()+1)
+	}
+
+	if s.table != nil {
+		ref := s.store(value)
+		s.refs = append(s.refs, ref)
+	} else {
+		if s.values == nil {
+			s.values = s.one[:0]
+		}
+		s.values = append(s.values, value)
+	}
+
+	s.size += int64(len(value))
+	if s.expires != nil {
+		s.expires = append(s.expires, expires)
+	}
+}
+
+// copyFrom appends the values of from between index i and j, with their expiries, to a state being built.
+// Values within the same generation of arena chunks are shared by offset rather than copied.
+func (s *keyState) copyFrom(from *keyState, i, j int) {
+	if from.expires != nil && s.expires == nil {
+		s.expires = make([]int64, s.len(), s.len()+j-i)
+	}
+
+	for ; i < j; i++ {
+		if s.table == nil || s.table.gen != from.table.gen {
+			s.add(from.value(i), from.expiry(i))
+			continue
+		}
+
+		// Tables of a generation only grow, the longer one resolves the offsets of both
+		if len(from.table.chunks) > len(s.table.chunks) {
+			s.table = from.table
+		}
+
+		s.refs = append(s.refs, from.refs[i])
+		s.size += int64(from.refs[i].len)
+		if s.expires != nil {
+			s.expires = append(s.expires, from.expiry(i))
+		}
+	}
+}
+
+// OperationType is the type of a queued write
+type OperationType int
+
+const (
+	OpPut            OperationType = iota // Add a value to a key
+	OpMerge                               // Merge an operand into a key's values
+	OpRemove                              // Remove a value from a key
+	OpDelete                              // Delete a key
+	OpSet                                 // Replace the values of a key with a single value
+	OpPutIfAbsent                         // Add a value to a key without values
+	OpCompareAndSwap                      // Replace the values of a key if they equal Expected
+	OpDeleteIfValues                      // Delete a key if its values equal Expected
+	OpCompute                             // Replace the values of a key with the result of a ComputeFunc
+)
+
+// Operation is a write waiting in the write queue
+type Operation struct {
+	Type     OperationType // Type of write
+	Key      []byte        // Key written
+	Value    []byte        // Value put or removed or operand merged
+	Expires  int64         // Expiry of a put value in unix nanoseconds, 0 for none
+	Values   [][]byte      // Values swapped in by a compare and swap
+	Expected [][]byte      // Values a conditional write compares against
+	compute  ComputeFunc   // Function computing the values of a compute
+	prev     []byte        // Previous value replaced by a set
+	values   [][]byte      // Values left by a compute
+	ok       bool          // Whether a set replaced a value or a conditional write or compute applied
+	result   chan error    // Receives the outcome once applied if the caller is waiting for it
+	pooled   bool          // Taken from the operation pool by newOperation, returned once applied
+}
+
+// WriteQueue is a queue of write operations, a ring buffer which grows as needed and shrinks once drained
 type WriteQueue struct {
-	items []*Key
+	items []*Operation // Ring buffer of queued operations
+	head  int          // Index of the oldest operation
+	size  int          // Number of queued operations
 }
 
-// Enqueue adds a new key to the write queue
+// minWriteQueueSize is the smallest the write queue's ring buffer shrinks to
+const minWriteQueueSize = 16
+
+// Enqueue adds a new put to the write queue
 func (q *WriteQueue) Enqueue(key, val []byte) {
-	q.items = append(q.items, &Key{K: key, Values: [][]byte{val}})
+	q.EnqueueOperation(&Operation{Type: OpPut, Key: key, Value: val})
+}
+
+// EnqueueOperation adds a new operation to the write queue
+func (q *WriteQueue) EnqueueOperation(op *Operation) {
+	if q.size == len(q.items) {
+		q.resize(max(2*len(q.items), minWriteQueueSize))
+	}
+
+	q.items[(q.head+q.size)%len(q.items)] = op
+	q.size++
 }
 
-// Dequeue removes a key from the write queue
-func (q *WriteQueue) Dequeue() *Key {
-	item := q.items[0]
-	q.items = q.items[1:]
+// Dequeue removes an operation from the write queue
+func (q *WriteQueue) Dequeue() *Operation {
+	item := q.items[q.head]
+	q.items[q.head] = nil // Release the operation for the garbage collector
+	q.head = (q.head + 1) % len(q.items)
+	q.size--
+
+	// Release memory after a burst once the queue is mostly empty
+	if len(q.items) > minWriteQueueSize && q.size <= len(q.items)/4 {
+		q.resize(len(q.items) / 2)
+	}
 	return item
 }
 
+// resize moves the queued operations into a ring buffer of n slots
+func (q *WriteQueue) resize(n int) {
+	items := make([]*Operation, n)
+	for i := 0; i < q.size; i++ {
+		items[i] = q.items[(q.head+i)%len(q.items)]
+	}
+	q.items, q.head = items, 0
+}
+
 // IsEmpty checks if the write queue is empty
 func (q *WriteQueue) IsEmpty() bool {
-	return len(q.items) == 0
+	return q.size == 0
 }
 
 // Size returns the size of the write queue
 func (q *WriteQueue) Size() int {
-	return len(q.items)
+	return q.size
 }
 
 // New creates a new BST
-func New() *BST {
-	bst := &BST{WriteQueue: WriteQueue{}, WriteQueueLock: &sync.Mutex{}, Exit: make(chan struct{})}
+func New(opts ...Option) *BST {
+	bst := &BST{WriteQueue: WriteQueue{}, WriteQueueLock: &sync.Mutex{}, Exit: make(chan struct{}), Wake: make(chan struct{}, 1), Writers: 1, ReapInterval: DefaultReapInterval, started: time.Now()}
+
+	for _, opt := range opts {
+		opt(bst)
+	}
 
-	// Start the background write queue
-	go bst.backgroundWriteQueue()
+	// Start the background write queues
+	bst.initWriters()
+	for _, w := range bst.writers {
+		go bst.backgroundWriteQueue(w)
+	}
+
+	// Start the background reaper for expired values
+	if bst.ReapInterval > 0 {
+		go bst.backgroundReaper()
+	}
 
 	return bst
 }
 
-func (bst *BST) backgroundWriteQueue() {
+// backgroundWriteQueue drains a writer's queue each time it is woken until the tree is closed
+func (bst *BST) backgroundWriteQueue(w *writer) {
 	for {
 		select {
 		case <-bst.Exit:
 			return
-		default:
-			if !bst.WriteQueue.IsEmpty() {
-				bst.WriteQueueLock.Lock()
-				key := bst.WriteQueue.Dequeue()
-				bst.PutOffQueue(key.K, key.Values[0])
-				bst.WriteQueueLock.Unlock()
+		case <-w.wake:
+			for !bst.closed() && bst.writeNext(w) {
 			}
 		}
 	}
 }
 
-// Put adds a new key to BST or append value to existing key
-func (bst *BST) Put(key, value []byte) {
+// closed checks if the tree has been closed
+func (bst *BST) closed() bool {
+	select {
+	case <-bst.Exit:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeNext applies the next write queued for w, returning false once its queue is empty
+func (bst *BST) writeNext(w *writer) bool {
+	w.lock.Lock()
+	if w.queue.IsEmpty() {
+		w.lock.Unlock()
+		return false
+	}
+
+	op := w.queue.Dequeue()
+	bst.gauge(MetricQueueDepth, atomic.AddInt64(&bst.queued, -1))
+	bst.signalSpace(w)
+	w.lock.Unlock()
+
+	// Apply the write without holding the queue lock so producers are not blocked behind it
+	err := bst.apply(op)
+	if op.result != nil {
+		op.result <- err
+	} else {
+		releaseOperation(op)
+	}
+	return true
+}
+
+// apply applies a write operation to the tree
+func (bst *BST) apply(op *Operation) error {
+	switch op.Type {
+	case OpPut:
+		bst.putOffQueue(op.Key, op.Value, op.Expires)
+	case OpMerge:
+		bst.mergeOffQueue(op.Key, op.Value)
+	case OpRemove:
+		return bst.removeOffQueue(op.Key, op.Value)
+	case OpDelete:
+		if !bst.deleteKey(op.Key, nil) {
+			return ErrKeyNotFound
+		}
+	case OpSet:
+		op.prev, op.ok = bst.setOffQueue(op.Key, op.Value)
+	case OpPutIfAbsent:
+		op.ok = bst.putIfAbsentOffQueue(op.Key, op.Value)
+	case OpCompareAndSwap:
+		op.ok = bst.compareAndSwapOffQueue(op.Key, op.Expected, op.Values)
+	case OpDeleteIfValues:
+		op.ok = bst.deleteIfValuesOffQueue(op.Key, op.Expected)
+	case OpCompute:
+		op.values, op.ok = bst.computeOffQueue(op.Key, op.compute)
+	}
+	return nil
+}
 
-	bst.WriteQueueLock.Lock()
-	defer bst.WriteQueueLock.Unlock()
-	// Enqueue the write operation
-	bst.WriteQueue.Enqueue(key, value)
+// applyQueued queues an operation behind earlier writes to the same key and waits for it to be applied
+func (bst *BST) applyQueued(op *Operation) error {
+	// With no background writer left to order against apply it directly
+	if bst.closed() {
+		return bst.apply(op)
+	}
+
+	op.result = make(chan error, 1)
+	if err := bst.enqueue(context.Background(), op); err != nil {
+		return err
+	}
 
+	select {
+	case err := <-op.result:
+		return err
+	case <-bst.Exit:
+		return ErrClosed
+	}
+}
+
+// Put adds a new key to BST or append value to existing key.  If the write queue is full the
+// write is handled according to the tree's QueuePolicy, with QueueFail it is dropped.
+func (bst *BST) Put(key, value []byte) {
+	bst.enqueue(context.Background(), bst.putOperation(OpPut, key, value, 0))
 }
 
 // PutOffQueue adds a new key to BST or append value to existing key
 func (bst *BST) PutOffQueue(key, value []byte) {
+	key, value = bst.ownPair(key, value)
+	bst.putOffQueue(key, value, 0)
+}
+
+// putOffQueue adds a new key to BST or append value to existing key, the value expires at expires, 0 for never
+func (bst *BST) putOffQueue(key, value []byte, expires int64) {
+	defer bst.notify(Event{Type: EventPut, Key: key, Value: value})
+	defer bst.observe(MetricPutDuration, time.Now())
+	bst.incr(MetricPuts, 1)
+
+	stored := bst.encode(value)
+	bst.upsert(key, func() *Key {
+		k := bst.newKey(key)
+		k.appendValue(stored, expires)
+		return k
+	}, func(existing *Key) {
+		existing.insertValue(stored, expires, bst.ValueMode)
+	})
+}
+
+// insert is an upsert in progress.  Its node is only built once an empty slot is found for it.
+type insert struct {
+	key    []byte // Key inserted
+	node   *Node  // Node to link, nil until built
+	linked bool   // Whether node was linked rather than an existing key updated
+}
+
+// build returns the node to link under parent, nil for the root, building its key with create on first use
+func (bst *BST) build(in *insert, create func() *Key, parent *Node) *Node {
+	if in.node == nil {
+		key := create()
+		if parent != nil {
+			bst.compress(key, parent.key())
+		}
+		in.node = bst.newNode(key)
+	}
+	return in.node
+}
 
-	newNode := &Node{Key: &Key{K: key, Values: [][]byte{value}, Latch: &sync.Mutex{}}, Latch: sync.Mutex{}}
+// upsert links a node for key into the BST, built by create, or calls update with the key latch held
+// if key already exists.  Returns whether a new node was linked.
+func (bst *BST) upsert(key []byte, create func() *Key, update func(*Key)) bool {
+	defer bst.evict()
+	defer bst.unpin(bst.pin())
+
+	in := insert{key: key}
 	for {
 		root := atomic.LoadPointer(&bst.Root)
 		if root == nil {
-			if atomic.CompareAndSwapPointer(&bst.Root, nil, unsafe.Pointer(newNode)) {
-				return
+			node := bst.build(&in, create, nil)
+			created := node.Key
+			if atomic.CompareAndSwapPointer(&bst.Root, nil, unsafe.Pointer(node)) {
+				bst.added(created)
+				return true
 			}
 		} else {
-			if bst.put(root, newNode) {
-				return
+			if bst.put(root, &in, create, update) {
+				// A node built before the key turned out to exist was never linked and can be reused
+				if !in.linked && in.node != nil {
+					bst.releaseNode(in.node)
+				}
+				return in.linked
 			}
 		}
+		bst.incr(MetricCASRetries, 1)
 	}
 }
 
-// put adds a new key to BST or append value to existing key
-func (bst *BST) put(rootPointer unsafe.Pointer, newNode *Node) bool {
+// put adds a new key to BST or updates the existing key, returning false if it must be retried
+func (bst *BST) put(rootPointer unsafe.Pointer, in *insert, create func() *Key, update func(*Key)) bool {
 	root := (*Node)(rootPointer)
+	k := root.key()
 
-	if bytes.Compare(newNode.Key.K, root.Key.K) < 0 {
+	if k.compare(in.key) > 0 {
 		left := atomic.LoadPointer(&root.Left)
 		if left == nil {
-			if atomic.CompareAndSwapPointer(&root.Left, nil, unsafe.Pointer(newNode)) {
+			node := bst.build(in, create, root)
+			created := node.Key
+			if atomic.CompareAndSwapPointer(&root.Left, nil, unsafe.Pointer(node)) {
+				bst.added(created)
+				in.linked = true
 				return true
 			}
 		} else {
-			return bst.put(left, newNode)
+			return bst.put(left, in, create, update)
 		}
-	} else if bytes.Compare(newNode.Key.K, root.Key.K) > 0 {
+	} else if k.compare(in.key) < 0 {
 		right := atomic.LoadPointer(&root.Right)
 		if right == nil {
-			if atomic.CompareAndSwapPointer(&root.Right, nil, unsafe.Pointer(newNode)) {
+			node := bst.build(in, create, root)
+			created := node.Key
+			if atomic.CompareAndSwapPointer(&root.Right, nil, unsafe.Pointer(node)) {
+				bst.added(created)
+				in.linked = true
 				return true
 			}
 		} else {
-			return bst.put(right, newNode)
+			return bst.put(right, in, create, update)
 		}
 	} else {
-		// If the keys are equal, append the new value to the existing key's values
+		// If the keys are equal, update the existing key's values
 
-		root.Key.Latch.Lock()
+		k.Latch.Lock()
+		defer k.Latch.Unlock()
 
-		root.Key.Values = append(root.Key.Values, newNode.Key.Values[0])
-		root.Key.Latch.Unlock()
+		// The key is being unlinked, retry once it is gone
+		if k.deleted {
+			return false
+		}
 
+		size := k.size
+		update(k)
+		bst.accessed(k)
+		bst.account(k.size - size)
 		return true
 	}
 	return false
@@ -164,8 +626,19 @@ func (bst *BST) put(rootPointer unsafe.Pointer, newNode *Node) bool {
 
 // Get retrieves a key from the BST
 func (bst *BST) Get(key []byte) *Key {
-	root := atomic.LoadPointer(&bst.Root)
-	return bst.get((*Node)(root), key)
+	defer bst.observe(MetricGetDuration, time.Now())
+	bst.incr(MetricGets, 1)
+
+	found := bst.find(key)
+	bst.accessed(found)
+
+	k := bst.view(found, time.Now().UnixNano())
+	if k == nil {
+		bst.incr(MetricGetMisses, 1)
+	} else {
+		bst.incr(MetricGetHits, 1)
+	}
+	return k
 }
 
 // get retrieves a key from the BST
@@ -174,80 +647,174 @@ func (bst *BST) get(node *Node, key []byte) *Key {
 		return nil
 	}
 
-	if bytes.Compare(key, node.Key.K) < 0 {
-		return bst.get((*Node)(node.Left), key)
-	} else if bytes.Compare(key, node.Key.K) > 0 {
-		return bst.get((*Node)(node.Right), key)
+	k := node.key()
+
+	if k.compare(key) > 0 {
+		return bst.get(node.left(), key)
+	} else if k.compare(key) < 0 {
+		return bst.get(node.right(), key)
 	}
 
-	return node.Key
+	return k
+}
+
+// Remove removes a value from a key, returning whether the value was removed.  The removal is
+// queued behind earlier writes to the key so it applies after them, Remove waits for it.
+func (bst *BST) Remove(key, value []byte) bool {
+	return bst.removeValue(key, value) == nil
+}
+
+// removeValue queues the removal of a value from a key and waits for it, returning ErrKeyNotFound
+// or ErrValueNotFound if there was nothing to remove
+func (bst *BST) removeValue(key, value []byte) error {
+	defer bst.observe(MetricRemoveDuration, time.Now())
+	bst.incr(MetricRemoves, 1)
+
+	return bst.applyQueued(&Operation{Type: OpRemove, Key: key, Value: value})
 }
 
-// Remove removes a value from a key
-func (bst *BST) Remove(key, value []byte) {
+// removeOffQueue removes a value from a key
+func (bst *BST) removeOffQueue(key, value []byte) error {
+	e := bst.pin()
 	root := atomic.LoadPointer(&bst.Root)
-	bst.remove((*Node)(root), key, value)
+	// Compression is deterministic, the value is found by its encoded form
+	err := bst.remove((*Node)(root), key, bst.encode(value))
+	bst.unpin(e)
+
+	if err == nil {
+		bst.notify(Event{Type: EventRemove, Key: key, Value: value})
+	}
+	return err
 }
 
 // remove removes a value from a key
-func (bst *BST) remove(node *Node, key, value []byte) {
+func (bst *BST) remove(node *Node, key, value []byte) error {
 	if node == nil {
-		return
+		return ErrKeyNotFound
 	}
 
-	if bytes.Compare(key, node.Key.K) < 0 {
-		bst.remove((*Node)(node.Left), key, value)
-	} else if bytes.Compare(key, node.Key.K) > 0 {
-		bst.remove((*Node)(node.Right), key, value)
-	} else {
-		node.Key.Latch.Lock()
-		for i, v := range node.Key.Values {
-			if bytes.Compare(v, value) == 0 {
-				node.Key.Values = append(node.Key.Values[:i], node.Key.Values[i+1:]...)
-				break
-			}
-		}
-		node.Key.Latch.Unlock()
+	k := node.key()
+
+	if k.compare(key) > 0 {
+		return bst.remove(node.left(), key, value)
+	} else if k.compare(key) < 0 {
+		return bst.remove(node.right(), key, value)
+	}
+
+	k.Latch.Lock()
+	defer k.Latch.Unlock()
+	if k.deleted {
+		return ErrKeyNotFound
+	}
+
+	if i := k.indexOf(value, bst.ValueMode); i >= 0 {
+		k.removeValue(i)
+		bst.account(-int64(len(value)))
+		return nil
 	}
+	return ErrValueNotFound
+}
+
+// Delete removes a key from the BST, returning whether the key was removed.  The deletion is
+// queued behind earlier writes to the key so it applies after them, Delete waits for it.
+func (bst *BST) Delete(key []byte) bool {
+	return bst.deleteQueued(key) == nil
+}
+
+// deleteQueued queues the deletion of a key and waits for it, returning ErrKeyNotFound if it did not exist
+func (bst *BST) deleteQueued(key []byte) error {
+	defer bst.observe(MetricDeleteDuration, time.Now())
+	bst.incr(MetricDeletes, 1)
+
+	return bst.applyQueued(&Operation{Type: OpDelete, Key: key})
 }
 
-// Delete removes a key from the BST
-func (bst *BST) Delete(key []byte) {
+// deleteKey removes a key from the BST if cond is nil or returns true for it, returning whether it was removed.
+// cond is called with the key latch held.
+func (bst *BST) deleteKey(key []byte, cond func(*Key) bool) bool {
+	bst.deleteLock.Lock()
+	e := bst.pin()
 	root := (*Node)(atomic.LoadPointer(&bst.Root))
-	newRoot := bst.delete(root, key)
+	newRoot, deleted := bst.delete(root, key, cond)
 	atomic.StorePointer(&bst.Root, unsafe.Pointer(newRoot))
+	bst.unpin(e)
+	bst.deleteLock.Unlock()
+
+	// Recycle unlinked nodes no reader can still observe
+	bst.advance()
+
+	if deleted {
+		bst.notify(Event{Type: EventDelete, Key: key})
+	}
+	return deleted
 }
 
-// delete removes a node from the BST
-func (bst *BST) delete(node *Node, key []byte) *Node {
+// delete removes a node from the BST, if cond is not nil the node is only removed when cond returns true for its key.
+// Returns the new root of the subtree and whether the node was removed.
+func (bst *BST) delete(node *Node, key []byte, cond func(*Key) bool) (*Node, bool) {
 	if node == nil {
-		return nil
+		return nil, false
 	}
 
 	node.Latch.Lock()         // Lock this node
 	defer node.Latch.Unlock() // Ensure it gets unlocked
 
-	if bytes.Compare(key, node.Key.K) < 0 {
-		node.Left = unsafe.Pointer(bst.delete((*Node)(node.Left), key))
-	} else if bytes.Compare(key, node.Key.K) > 0 {
-		node.Right = unsafe.Pointer(bst.delete((*Node)(node.Right), key))
+	deleted := false
+	if node.Key.compare(key) > 0 {
+		var left *Node
+		left, deleted = bst.delete(node.left(), key, cond)
+		node.setLeft(left)
+	} else if node.Key.compare(key) < 0 {
+		var right *Node
+		right, deleted = bst.delete(node.right(), key, cond)
+		node.setRight(right)
 	} else {
+		// Check the condition and mark the key deleted atomically so no writer can update it in between
+		node.Key.Latch.Lock()
+		if cond != nil && !cond(node.Key) {
+			node.Key.Latch.Unlock()
+			return node, false
+		}
+		node.Key.deleted = true
+		bst.account(-node.Key.size)
+		node.Key.Latch.Unlock()
+
 		// node with only one child or no child
-		if node.Left == nil {
-			return (*Node)(node.Right)
-		} else if node.Right == nil {
-			return (*Node)(node.Left)
+		if node.left() == nil {
+			bst.gauge(MetricNodes, atomic.AddInt64(&bst.nodes, -1))
+			bst.retire(node)
+			return node.right(), true
+		} else if node.right() == nil {
+			bst.gauge(MetricNodes, atomic.AddInt64(&bst.nodes, -1))
+			bst.retire(node)
+			return node.left(), true
 		}
 
 		// node with two children: get the inorder successor (smallest in the right subtree)
-		minNode := bst.minValueNode((*Node)(node.Right))
+		minNode := bst.minValueNode(node.right())
 
 		// copy the inorder successor's content to this node
-		node.Key = minNode.Key
+		node.setKey(minNode.Key)
 
-		// delete the inorder successor
-		node.Right = unsafe.Pointer(bst.delete((*Node)(node.Right), minNode.Key.K))
+		// delete the inorder successor, its key lives on in this node so it is not marked deleted
+		node.setRight(bst.deleteMin(node.right()))
+		bst.gauge(MetricNodes, atomic.AddInt64(&bst.nodes, -1))
+		deleted = true
 	}
+	return node, deleted
+}
+
+// deleteMin unlinks the node with the minimum key from the subtree, returning the new root of the subtree
+func (bst *BST) deleteMin(node *Node) *Node {
+	node.Latch.Lock()
+	defer node.Latch.Unlock()
+
+	if node.left() == nil {
+		bst.retire(node)
+		return node.right()
+	}
+
+	node.setLeft(bst.deleteMin(node.left()))
 	return node
 }
 
@@ -256,187 +823,271 @@ func (bst *BST) minValueNode(node *Node) *Node {
 	current := node
 
 	// loop down to find the leftmost leaf
-	for (*Node)(current.Left) != nil {
-		current = (*Node)(current.Left)
+	for current.left() != nil {
+		current = current.left()
 	}
 	return current
 }
 
 // Range retrieves all keys within a range
 func (bst *BST) Range(start, end []byte) []*Key {
+	keys, _ := bst.RangeContext(context.Background(), start, end)
+	return keys
+}
+
+// RangeContext retrieves all keys within a range, returning ctx's error if it is done before the traversal completes
+func (bst *BST) RangeContext(ctx context.Context, start, end []byte) ([]*Key, error) {
+	defer bst.observe(MetricRangeDuration, time.Now())
+
+	defer bst.unpin(bst.pin())
 	var keys []*Key
 	root := atomic.LoadPointer(&bst.Root)
-	bst.rangeKeys((*Node)(root), start, end, &keys)
-	return keys
+	bst.rangeKeys((*Node)(root), start, end, &keys, ctx.Done())
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return bst.views(keys), nil
 }
 
 // rangeKeys retrieves all keys within a range
-func (bst *BST) rangeKeys(node *Node, start, end []byte, keys *[]*Key) {
-	if node == nil {
+func (bst *BST) rangeKeys(node *Node, start, end []byte, keys *[]*Key, done <-chan struct{}) {
+	if node == nil || cancelled(done) {
 		return
 	}
 
+	k := node.key()
+
 	// If the current node's key is greater than the start key, then there might be keys in the left subtree that are in the range
-	if bytes.Compare(node.Key.K, start) > 0 {
-		bst.rangeKeys((*Node)(node.Left), start, end, keys)
+	if k.compare(start) > 0 {
+		bst.rangeKeys(node.left(), start, end, keys, done)
 	}
 
 	// If the current node's key is within the range, add it to the keys slice
-	if bytes.Compare(node.Key.K, start) >= 0 && bytes.Compare(node.Key.K, end) <= 0 {
-		*keys = append(*keys, node.Key)
+	if k.compare(start) >= 0 && k.compare(end) <= 0 {
+		*keys = append(*keys, k)
 	}
 
 	// If the current node's key is less than the end key, then there might be keys in the right subtree that are in the range
-	if bytes.Compare(node.Key.K, end) < 0 {
-		bst.rangeKeys((*Node)(node.Right), start, end, keys)
+	if k.compare(end) < 0 {
+		bst.rangeKeys(node.right(), start, end, keys, done)
 	}
 }
 
 // GreaterThan retrieves all keys greater than the specified key
 func (bst *BST) GreaterThan(key []byte) []*Key {
+	keys, _ := bst.GreaterThanContext(context.Background(), key)
+	return keys
+}
+
+// GreaterThanContext retrieves all keys greater than the specified key, returning ctx's error if it is done before the traversal completes
+func (bst *BST) GreaterThanContext(ctx context.Context, key []byte) ([]*Key, error) {
+	defer bst.observe(MetricRangeDuration, time.Now())
+
+	defer bst.unpin(bst.pin())
 	var keys []*Key
 	root := atomic.LoadPointer(&bst.Root)
-	bst.greaterThan((*Node)(root), key, &keys)
-	return keys
+	bst.greaterThan((*Node)(root), key, &keys, ctx.Done())
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return bst.views(keys), nil
 }
 
 // greaterThan is a helper function to find keys greater than the specified key
-func (bst *BST) greaterThan(node *Node, key []byte, keys *[]*Key) {
-	if node == nil {
+func (bst *BST) greaterThan(node *Node, key []byte, keys *[]*Key, done <-chan struct{}) {
+	if node == nil || cancelled(done) {
 		return
 	}
 
+	k := node.key()
+
 	// If the current node's key is greater than the specified key,
 	// we need to check the left subtree first (for potentially smaller keys)
-	if bytes.Compare(node.Key.K, key) > 0 {
-		bst.greaterThan((*Node)(node.Left), key, keys)
+	if k.compare(key) > 0 {
+		bst.greaterThan(node.left(), key, keys, done)
 
 		// Since the current node's key is greater, add it to the keys slice
-		*keys = append(*keys, node.Key)
+		*keys = append(*keys, k)
 
 		// Continue searching in the right subtree for more keys
-		bst.greaterThan((*Node)(node.Right), key, keys)
+		bst.greaterThan(node.right(), key, keys, done)
 	} else {
 		// If the current node's key is not greater, only search in the right subtree
-		bst.greaterThan((*Node)(node.Right), key, keys)
+		bst.greaterThan(node.right(), key, keys, done)
 	}
 }
 
 // GreaterThanEq retrieves all keys greater than or equal to the specified key
 func (bst *BST) GreaterThanEq(key []byte) []*Key {
+	keys, _ := bst.GreaterThanEqContext(context.Background(), key)
+	return keys
+}
+
+// GreaterThanEqContext retrieves all keys greater than or equal to the specified key, returning ctx's error if it is done before the traversal completes
+func (bst *BST) GreaterThanEqContext(ctx context.Context, key []byte) ([]*Key, error) {
+	defer bst.observe(MetricRangeDuration, time.Now())
+
+	defer bst.unpin(bst.pin())
 	var keys []*Key
 	root := atomic.LoadPointer(&bst.Root)
-	bst.greaterThanEq((*Node)(root), key, &keys)
-	return keys
+	bst.greaterThanEq((*Node)(root), key, &keys, ctx.Done())
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return bst.views(keys), nil
 }
 
 // greaterThanEq is a helper function to find keys greater than or equal to the specified key
-func (bst *BST) greaterThanEq(node *Node, key []byte, keys *[]*Key) {
-	if node == nil {
+func (bst *BST) greaterThanEq(node *Node, key []byte, keys *[]*Key, done <-chan struct{}) {
+	if node == nil || cancelled(done) {
 		return
 	}
 
+	k := node.key()
+
 	// If the current node's key is greater than or equal to the specified key,
 	// we need to check the left subtree first (for potentially smaller keys)
-	if bytes.Compare(node.Key.K, key) >= 0 {
-		// Include the current node's key
-		*keys = append(*keys, node.Key)
-
+	if k.compare(key) >= 0 {
 		// Continue searching in the left subtree for more keys
-		bst.greaterThanEq((*Node)(node.Left), key, keys)
+		bst.greaterThanEq(node.left(), key, keys, done)
+
+		// Include the current node's key
+		*keys = append(*keys, k)
 
 		// Search in the right subtree for additional greater keys
-		bst.greaterThanEq((*Node)(node.Right), key, keys)
+		bst.greaterThanEq(node.right(), key, keys, done)
 	} else {
 		// If the current node's key is less than the specified key, only search in the right subtree
-		bst.greaterThanEq((*Node)(node.Right), key, keys)
+		bst.greaterThanEq(node.right(), key, keys, done)
 	}
 }
 
 // LessThan retrieves all keys less than the specified key
 func (bst *BST) LessThan(key []byte) []*Key {
+	keys, _ := bst.LessThanContext(context.Background(), key)
+	return keys
+}
+
+// LessThanContext retrieves all keys less than the specified key, returning ctx's error if it is done before the traversal completes
+func (bst *BST) LessThanContext(ctx context.Context, key []byte) ([]*Key, error) {
+	defer bst.observe(MetricRangeDuration, time.Now())
+
+	defer bst.unpin(bst.pin())
 	var keys []*Key
 	root := atomic.LoadPointer(&bst.Root)
-	bst.lessThan((*Node)(root), key, &keys)
-	return keys
+	bst.lessThan((*Node)(root), key, &keys, ctx.Done())
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return bst.views(keys), nil
 }
 
 // lessThan is a helper function to find keys less than the specified key
-func (bst *BST) lessThan(node *Node, key []byte, keys *[]*Key) {
-	if node == nil {
+func (bst *BST) lessThan(node *Node, key []byte, keys *[]*Key, done <-chan struct{}) {
+	if node == nil || cancelled(done) {
 		return
 	}
 
+	k := node.key()
+
 	// If the current node's key is less than the specified key,
 	// we need to check the left subtree first (for potentially smaller keys)
-	if bytes.Compare(node.Key.K, key) < 0 {
-		*keys = append(*keys, node.Key)
-
+	if k.compare(key) < 0 {
 		// Continue searching in the left subtree
-		bst.lessThan((*Node)(node.Left), key, keys)
+		bst.lessThan(node.left(), key, keys, done)
+
+		*keys = append(*keys, k)
 
 		// Search in the right subtree for more keys that might also be less
-		bst.lessThan((*Node)(node.Right), key, keys)
+		bst.lessThan(node.right(), key, keys, done)
 	} else {
 		// If the current node's key is not less, only search in the left subtree
-		bst.lessThan((*Node)(node.Left), key, keys)
+		bst.lessThan(node.left(), key, keys, done)
 	}
 }
 
 // LessThanEq retrieves all keys less than or equal to the specified key
 func (bst *BST) LessThanEq(key []byte) []*Key {
+	keys, _ := bst.LessThanEqContext(context.Background(), key)
+	return keys
+}
+
+// LessThanEqContext retrieves all keys less than or equal to the specified key, returning ctx's error if it is done before the traversal completes
+func (bst *BST) LessThanEqContext(ctx context.Context, key []byte) ([]*Key, error) {
+	defer bst.observe(MetricRangeDuration, time.Now())
+
+	defer bst.unpin(bst.pin())
 	var keys []*Key
 	root := atomic.LoadPointer(&bst.Root)
-	bst.lessThanEq((*Node)(root), key, &keys)
-	return keys
+	bst.lessThanEq((*Node)(root), key, &keys, ctx.Done())
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return bst.views(keys), nil
 }
 
 // lessThanEq is a helper function to find keys less than or equal to the specified key
-func (bst *BST) lessThanEq(node *Node, key []byte, keys *[]*Key) {
-	if node == nil {
+func (bst *BST) lessThanEq(node *Node, key []byte, keys *[]*Key, done <-chan struct{}) {
+	if node == nil || cancelled(done) {
 		return
 	}
 
+	k := node.key()
+
 	// If the current node's key is less than or equal to the specified key,
 	// we need to check the left subtree first (for potentially smaller keys)
-	if bytes.Compare(node.Key.K, key) <= 0 {
-		*keys = append(*keys, node.Key)
-
+	if k.compare(key) <= 0 {
 		// Continue searching in the left subtree
-		bst.lessThanEq((*Node)(node.Left), key, keys)
+		bst.lessThanEq(node.left(), key, keys, done)
+
+		*keys = append(*keys, k)
 
 		// Search in the right subtree for more keys that might also be less than or equal
-		bst.lessThanEq((*Node)(node.Right), key, keys)
+		bst.lessThanEq(node.right(), key, keys, done)
 	} else {
 		// If the current node's key is greater, only search in the left subtree
-		bst.lessThanEq((*Node)(node.Left), key, keys)
+		bst.lessThanEq(node.left(), key, keys, done)
 	}
 }
 
 // NGet retrieves all keys except the specified key
 func (bst *BST) NGet(key []byte) []*Key {
+	keys, _ := bst.NGetContext(context.Background(), key)
+	return keys
+}
+
+// NGetContext retrieves all keys except the specified key, returning ctx's error if it is done before the traversal completes
+func (bst *BST) NGetContext(ctx context.Context, key []byte) ([]*Key, error) {
+	defer bst.observe(MetricRangeDuration, time.Now())
+
+	defer bst.unpin(bst.pin())
 	var keys []*Key
 	root := atomic.LoadPointer(&bst.Root)
-	bst.nGet((*Node)(root), key, &keys)
-	return keys
+	bst.nGet((*Node)(root), key, &keys, ctx.Done())
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return bst.views(keys), nil
 }
 
 // nGet is a helper function to find all keys except the specified key
-func (bst *BST) nGet(node *Node, key []byte, keys *[]*Key) {
-	if node == nil {
+func (bst *BST) nGet(node *Node, key []byte, keys *[]*Key, done <-chan struct{}) {
+	if node == nil || cancelled(done) {
 		return
 	}
 
+	k := node.key()
+
 	// Check the left subtree first
-	bst.nGet((*Node)(node.Left), key, keys)
+	bst.nGet(node.left(), key, keys, done)
 
 	// If the current node's key does not match the specified key, add it to the keys slice
-	if bytes.Compare(node.Key.K, key) != 0 {
-		*keys = append(*keys, node.Key)
+	if k.compare(key) != 0 {
+		*keys = append(*keys, k)
 	}
 
 	// Check the right subtree
-	bst.nGet((*Node)(node.Right), key, keys)
+	bst.nGet(node.right(), key, keys, done)
 }
 
 // NodePos is the position of the node in the tree, either left, right, or root
@@ -448,8 +1099,9 @@ const (
 	Root
 )
 
-// Print displays the BST values in-order
+// Print displays the BST values in-order on stderr, see Render and WriteDOT for structured output
 func (bst *BST) Print() {
+	defer bst.unpin(bst.pin())
 	root := atomic.LoadPointer(&bst.Root)
 	bst.print((*Node)(root), Root)
 }
@@ -459,16 +1111,18 @@ func (bst *BST) print(node *Node, pos NodePos) {
 	if node == nil {
 		return
 	}
-	bst.print((*Node)(node.Left), Left)
+
+	k := node.key()
+	bst.print(node.left(), Left)
 	switch pos {
 	case Left:
-		println("L: ", string(node.Key.K))
+		println("L: ", string(k.bytes()))
 	case Right:
-		println("R: ", string(node.Key.K))
+		println("R: ", string(k.bytes()))
 	case Root:
-		println("ROOT: ", string(node.Key.K))
+		println("ROOT: ", string(k.bytes()))
 	}
-	bst.print((*Node)(node.Right), Right)
+	bst.print(node.right(), Right)
 }
 
 func (bst *BST) Close() {
@@ -17,6 +17,7 @@
 package bst
 
 import (
+	"bytes"
 	"fmt"
 	"sync"
 	"testing"
@@ -398,7 +399,8 @@ func TestBST_ConcurrentGet(t *testing.T) {
 				key := fmt.Sprintf("key%02d-%d", j, goroutineID)
 				val := bst.Get([]byte(key))
 				if val == nil {
-					t.Fatalf("Expected key %s not found", key)
+					t.Errorf("Expected key %s not found", key)
+					return
 				}
 			}
 		}(i)
@@ -436,7 +438,8 @@ func TestBST_ConcurrentDelete(t *testing.T) {
 				// Verify that the key has been deleted
 				val := bst.Get([]byte(key))
 				if val != nil {
-					t.Fatalf("Expected key %s to be deleted", key)
+					t.Errorf("Expected key %s to be deleted", key)
+					return
 				}
 			}
 		}(i)
@@ -595,3 +598,31 @@ func TestBST_Insert1MillionKeys(t *testing.T) {
 	elapsed := time.Since(start)
 	fmt.Printf("Insert 1 million keys took %s\n", elapsed)
 }
+
+func TestBST_ComparisonOrder(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	// Insert out of order so the tree is not a single chain
+	for _, i := range []int{5, 2, 8, 1, 3, 7, 9, 0, 4, 6} {
+		bst.PutOffQueue([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+
+	queries := map[string][]*Key{
+		"GreaterThan":   bst.GreaterThan([]byte("key03")),
+		"GreaterThanEq": bst.GreaterThanEq([]byte("key03")),
+		"LessThan":      bst.LessThan([]byte("key07")),
+		"LessThanEq":    bst.LessThanEq([]byte("key07")),
+	}
+
+	for name, keys := range queries {
+		for i := 1; i < len(keys); i++ {
+			if bytes.Compare(keys[i-1].K, keys[i].K) >= 0 {
+				t.Fatalf("%s: expected keys in order, got %s before %s", name, keys[i-1].K, keys[i].K)
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bytes"
+	"time"
+)
+
+// CompareAndSwap replaces the values of a key with newValues only if its current values equal oldValues.
+// An empty oldValues matches a key that does not exist or has no values, in which case the key is created.
+// newValues are stored as the tree's ValueMode holds them, deduplicated for sets and sorted for sorted sets,
+// and the swap fails for more than one value in ValueMap.  It is queued behind earlier writes to the key
+// and waits for them, returning whether the swap happened.
+func (bst *BST) CompareAndSwap(key []byte, oldValues, newValues [][]byte) bool {
+	op := &Operation{Type: OpCompareAndSwap, Key: key, Expected: oldValues, Values: newValues}
+	return bst.applyQueued(op) == nil && op.ok
+}
+
+// compareAndSwapOffQueue replaces the values of a key with newValues if its current values equal oldValues
+func (bst *BST) compareAndSwapOffQueue(key []byte, oldValues, newValues [][]byte) bool {
+	// A map holds a single value
+	if bst.ValueMode == ValueMap && len(newValues) > 1 {
+		return false
+	}
+	newValues = normalize(newValues, bst.ValueMode)
+
+	if len(oldValues) > 0 {
+		return bst.swap(key, oldValues, newValues)
+	}
+
+	swapped := false
+	inserted := bst.upsert(key, func() *Key {
+		k := bst.newKey(bst.keep(key))
+		k.setValues(bst.keepValues(newValues), nil)
+		return k
+	}, func(existing *Key) {
+		if len(existing.load().liveValues(time.Now().UnixNano())) == 0 {
+			existing.setValues(bst.keepValues(newValues), nil)
+			swapped = true
+		}
+	})
+
+	if inserted || swapped {
+		bst.notifyValues(key, newValues)
+		return true
+	}
+	return false
+}
+
+// swap replaces the values of an existing key if they equal oldValues
+func (bst *BST) swap(key []byte, oldValues, newValues [][]byte) bool {
+	for {
+		k := bst.find(key)
+		if k == nil {
+			return false
+		}
+
+		k.Latch.Lock()
+		if k.deleted {
+			// The key is being unlinked, look it up again
+			k.Latch.Unlock()
+			continue
+		}
+
+		if !valuesEqual(bst.decodeValues(k.load().liveValues(time.Now().UnixNano())), oldValues) {
+			k.Latch.Unlock()
+			return false
+		}
+
+		size := k.size
+		k.setValues(bst.keepValues(newValues), nil)
+		bst.account(k.size - size)
+		k.Latch.Unlock()
+		bst.evict()
+
+		bst.notifyValues(key, newValues)
+		return true
+	}
+}
+
+// PutIfAbsent adds a value to a key only if the key does not exist or has no values.
+// It is queued behind earlier writes to the key and waits for them, returning whether the value was put.
+func (bst *BST) PutIfAbsent(key, value []byte) bool {
+	op := &Operation{Type: OpPutIfAbsent, Key: key, Value: value}
+	return bst.applyQueued(op) == nil && op.ok
+}
+
+// putIfAbsentOffQueue adds a value to a key if the key does not exist or has no values
+func (bst *BST) putIfAbsentOffQueue(key, value []byte) bool {
+	put := false
+	inserted := bst.upsert(key, func() *Key {
+		k := bst.newKey(bst.keep(key))
+		k.appendValue(bst.keepValue(value), 0)
+		return k
+	}, func(existing *Key) {
+		if len(existing.load().liveValues(time.Now().UnixNano())) == 0 {
+			existing.replaceValue(bst.keepValue(value), 0)
+			put = true
+		}
+	})
+
+	if inserted || put {
+		bst.incr(MetricPuts, 1)
+		bst.notify(Event{Type: EventPut, Key: key, Value: value})
+		return true
+	}
+	return false
+}
+
+// DeleteIfValues deletes a key only if its current values equal expected, returning whether it was deleted.
+// It is queued behind earlier writes to the key and waits for them.
+func (bst *BST) DeleteIfValues(key []byte, expected [][]byte) bool {
+	op := &Operation{Type: OpDeleteIfValues, Key: key, Expected: expected}
+	return bst.applyQueued(op) == nil && op.ok
+}
+
+// deleteIfValuesOffQueue deletes a key if its current values equal expected
+func (bst *BST) deleteIfValuesOffQueue(key []byte, expected [][]byte) bool {
+	bst.incr(MetricDeletes, 1)
+
+	return bst.deleteKey(key, func(k *Key) bool {
+		return valuesEqual(bst.decodeValues(k.load().liveValues(time.Now().UnixNano())), expected)
+	})
+}
+
+// notifyValues sends a put event for each value
+func (bst *BST) notifyValues(key []byte, values [][]byte) {
+	for _, v := range values {
+		bst.notify(Event{Type: EventPut, Key: key, Value: v})
+	}
+}
+
+// valuesEqual checks if two lists of values are equal
+func valuesEqual(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// copyValues copies a list of values so the caller's slice is not shared with the tree
+func copyValues(values [][]byte) [][]byte {
+	return append([][]byte(nil), values...)
+}
@@ -0,0 +1,198 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBST_CompareAndSwap(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	if !bst.CompareAndSwap([]byte("key"), nil, [][]byte{[]byte("a")}) {
+		t.Fatal("expected swap on absent key to create it")
+	}
+
+	if bst.CompareAndSwap([]byte("key"), nil, [][]byte{[]byte("b")}) {
+		t.Fatal("expected swap on existing key with empty old values to fail")
+	}
+
+	if bst.CompareAndSwap([]byte("key"), [][]byte{[]byte("b")}, [][]byte{[]byte("c")}) {
+		t.Fatal("expected swap with wrong old values to fail")
+	}
+
+	if !bst.CompareAndSwap([]byte("key"), [][]byte{[]byte("a")}, [][]byte{[]byte("b"), []byte("c")}) {
+		t.Fatal("expected swap to succeed")
+	}
+
+	key := bst.Get([]byte("key"))
+	if len(key.Values) != 2 || string(key.Values[0]) != "b" || string(key.Values[1]) != "c" {
+		t.Fatal("expected values to be b and c")
+	}
+
+	if bst.CompareAndSwap([]byte("missing"), [][]byte{[]byte("a")}, nil) {
+		t.Fatal("expected swap on missing key to fail")
+	}
+}
+
+func TestBST_ConcurrentCompareAndSwap(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.Set([]byte("counter"), []byte("0"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				for {
+					old := bst.Get([]byte("counter")).Values[0]
+					n, _ := strconv.Atoi(string(old))
+					if bst.CompareAndSwap([]byte("counter"), [][]byte{old}, [][]byte{[]byte(strconv.Itoa(n + 1))}) {
+						break
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if v := string(bst.Get([]byte("counter")).Values[0]); v != "1000" {
+		t.Fatalf("expected counter to be 1000, got %s", v)
+	}
+}
+
+func TestBST_PutIfAbsent(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	var wins int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if bst.PutIfAbsent([]byte("key"), []byte(strconv.Itoa(i))) {
+				atomic.AddInt32(&wins, 1)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if wins != 1 {
+		t.Fatalf("expected exactly one winner, got %d", wins)
+	}
+
+	if len(bst.Get([]byte("key")).Values) != 1 {
+		t.Fatal("expected a single value")
+	}
+}
+
+func TestBST_DeleteIfValues(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.Set([]byte("key"), []byte("value"))
+
+	if bst.DeleteIfValues([]byte("key"), [][]byte{[]byte("other")}) {
+		t.Fatal("expected delete with wrong values to fail")
+	}
+
+	if bst.Get([]byte("key")) == nil {
+		t.Fatal("expected key to remain")
+	}
+
+	if !bst.DeleteIfValues([]byte("key"), [][]byte{[]byte("value")}) {
+		t.Fatal("expected delete to succeed")
+	}
+
+	if bst.Get([]byte("key")) != nil {
+		t.Fatal("expected key to be deleted")
+	}
+
+	// A put after the delete creates a fresh key rather than updating the deleted one
+	if !bst.PutIfAbsent([]byte("key"), []byte("value 2")) {
+		t.Fatal("expected put after delete to succeed")
+	}
+}
+
+func TestBST_CompareAndSwapValueMode(t *testing.T) {
+	sorted := New(WithValueMode(ValueSortedSet))
+
+	defer func() {
+		sorted.Close()
+	}()
+
+	values := [][]byte{[]byte("c"), []byte("a"), []byte("a")}
+	if !sorted.CompareAndSwap([]byte("key"), nil, values) {
+		t.Fatal("expected the swap to create the key")
+	}
+
+	key := sorted.Get([]byte("key"))
+	if key == nil || len(key.Values) != 2 || string(key.Values[0]) != "a" || string(key.Values[1]) != "c" {
+		t.Fatalf("expected the values sorted without duplicates")
+	}
+
+	if !sorted.Remove([]byte("key"), []byte("a")) {
+		t.Fatal("expected the sorted value to be removed")
+	}
+
+	set := New(WithValueMode(ValueSet))
+
+	defer func() {
+		set.Close()
+	}()
+
+	set.CompareAndSwap([]byte("key"), nil, [][]byte{[]byte("b"), []byte("a"), []byte("b")})
+	if key := set.Get([]byte("key")); key == nil || len(key.Values) != 2 || string(key.Values[0]) != "b" {
+		t.Fatalf("expected the values without duplicates in order")
+	}
+
+	single := New(WithValueMode(ValueMap))
+
+	defer func() {
+		single.Close()
+	}()
+
+	if single.CompareAndSwap([]byte("key"), nil, [][]byte{[]byte("a"), []byte("b")}) {
+		t.Fatal("expected the swap of two values into a map to fail")
+	}
+
+	if single.Get([]byte("key")) != nil {
+		t.Fatal("expected the key not to be created")
+	}
+}
@@ -0,0 +1,226 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultCompressThreshold is the default size in bytes above which values are compressed
+const DefaultCompressThreshold = 1024
+
+// Metric names reported by value compression
+const (
+	MetricCompressedValues   = "bst_compressed_values_total"    // Values compressed on write
+	MetricCompressedRawBytes = "bst_compressed_raw_bytes_total" // Bytes of values before compression
+	MetricCompressedBytes    = "bst_compressed_bytes_total"     // Bytes of values after compression
+	MetricDecompressErrors   = "bst_decompress_errors_total"    // Stored values which failed to decompress
+)
+
+// Tags prefixed to each stored value while a codec is set
+const (
+	rawValue        byte = 0 // The value follows as is
+	compressedValue byte = 1 // The value follows compressed by the codec
+)
+
+// Codec compresses values.  Compression must be deterministic, the same value always compresses
+// to the same bytes, as values are compared in their compressed form.
+type Codec interface {
+	Compress(dst, src []byte) []byte            // Compress appends src compressed to dst
+	Decompress(dst, src []byte) ([]byte, error) // Decompress appends src decompressed to dst
+}
+
+// FlateCodec is a Codec using compress/flate
+type FlateCodec struct {
+	level   int       // Compression level
+	writers sync.Pool // Pooled *flate.Writer
+	readers sync.Pool // Pooled flate readers
+}
+
+// NewFlateCodec creates a flate codec compressing at level, one of the compress/flate levels.
+// It returns ErrInvalidLevel for any other level.
+func NewFlateCodec(level int) (*FlateCodec, error) {
+	w, err := flate.NewWriter(io.Discard, level)
+	if err != nil {
+		return nil, ErrInvalidLevel
+	}
+
+	c := &FlateCodec{level: level}
+	c.writers.Put(w)
+	return c, nil
+}
+
+// Compress appends src compressed to dst
+func (c *FlateCodec) Compress(dst, src []byte) []byte {
+	buf := bytes.NewBuffer(dst)
+
+	w, ok := c.writers.Get().(*flate.Writer)
+	if ok {
+		w.Reset(buf)
+	} else {
+		w, _ = flate.NewWriter(buf, c.level)
+	}
+
+	w.Write(src)
+	w.Close()
+	c.writers.Put(w)
+	return buf.Bytes()
+}
+
+// Decompress appends src decompressed to dst
+func (c *FlateCodec) Decompress(dst, src []byte) ([]byte, error) {
+	r, ok := c.readers.Get().(io.ReadCloser)
+	if ok {
+		r.(flate.Resetter).Reset(bytes.NewReader(src), nil)
+	} else {
+		r = flate.NewReader(bytes.NewReader(src))
+	}
+	defer c.readers.Put(r)
+
+	buf := bytes.NewBuffer(dst)
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// CompressionStats are the values compressed and their sizes
+type CompressionStats struct {
+	Values          int64 // Values compressed
+	RawBytes        int64 // Bytes of the values before compression
+	CompressedBytes int64 // Bytes of the values after compression
+	Errors          int64 // Stored values which failed to decompress on read
+}
+
+// Ratio returns the raw bytes per compressed byte, 0 if nothing was compressed
+func (s CompressionStats) Ratio() float64 {
+	if s.CompressedBytes == 0 {
+		return 0
+	}
+	return float64(s.RawBytes) / float64(s.CompressedBytes)
+}
+
+// compression counts the values compressed and their sizes
+type compression struct {
+	values   int64 // Values compressed
+	rawBytes int64 // Bytes of the values before compression
+	bytes    int64 // Bytes of the values after compression
+	errors   int64 // Stored values which failed to decompress
+}
+
+// WithCodec compresses values larger than threshold bytes with codec, DefaultCompressThreshold if
+// threshold is 0 or less.  Values are decompressed for reads, exports, merge operators and Compute.
+// Values of a sorted set are not compressed so they keep their order.
+func WithCodec(codec Codec, threshold int) Option {
+	return func(bst *BST) {
+		bst.Codec = codec
+		bst.CompressThreshold = threshold
+		if threshold <= 0 {
+			bst.CompressThreshold = DefaultCompressThreshold
+		}
+	}
+}
+
+// CompressionStats returns the values compressed and their sizes
+func (bst *BST) CompressionStats() CompressionStats {
+	return CompressionStats{
+		Values:          atomic.LoadInt64(&bst.compressed.values),
+		RawBytes:        atomic.LoadInt64(&bst.compressed.rawBytes),
+		CompressedBytes: atomic.LoadInt64(&bst.compressed.bytes),
+		Errors:          atomic.LoadInt64(&bst.compressed.errors),
+	}
+}
+
+// compressing checks if values are stored encoded by the codec
+func (bst *BST) compressing() bool {
+	return bst.Codec != nil && bst.ValueMode != ValueSortedSet
+}
+
+// encode returns a value as stored, tagged and compressed if above the threshold.  It returns the
+// value itself without a codec, otherwise a new slice.
+func (bst *BST) encode(v []byte) []byte {
+	if !bst.compressing() || v == nil {
+		return v
+	}
+
+	if len(v) > bst.CompressThreshold {
+		enc := bst.Codec.Compress(append(make([]byte, 0, len(v)/2+1), compressedValue), v)
+
+		// Only keep the compressed form if it is smaller
+		if len(enc) < len(v)+1 {
+			atomic.AddInt64(&bst.compressed.values, 1)
+			atomic.AddInt64(&bst.compressed.rawBytes, int64(len(v)))
+			atomic.AddInt64(&bst.compressed.bytes, int64(len(enc)-1))
+			bst.incr(MetricCompressedValues, 1)
+			bst.incr(MetricCompressedRawBytes, int64(len(v)))
+			bst.incr(MetricCompressedBytes, int64(len(enc)-1))
+			return enc
+		}
+	}
+
+	return append(append(make([]byte, 0, len(v)+1), rawValue), v...)
+}
+
+// decode returns a stored value as written.  Uncompressed values share the stored bytes.  A value
+// which fails to decompress, which the codec's own output never does, is counted in CompressionStats
+// and MetricDecompressErrors and returned as nil.
+func (bst *BST) decode(v []byte) []byte {
+	if !bst.compressing() || len(v) == 0 {
+		return v
+	}
+
+	if v[0] == compressedValue {
+		dec, err := bst.Codec.Decompress(nil, v[1:])
+		if err != nil {
+			atomic.AddInt64(&bst.compressed.errors, 1)
+			bst.incr(MetricDecompressErrors, 1)
+			return nil
+		}
+		return dec
+	}
+	return v[1:]
+}
+
+// encodeValues returns a new list of values each encoded, or values itself without a codec
+func (bst *BST) encodeValues(values [][]byte) [][]byte {
+	if !bst.compressing() {
+		return values
+	}
+
+	encoded := make([][]byte, len(values))
+	for i, v := range values {
+		encoded[i] = bst.encode(v)
+	}
+	return encoded
+}
+
+// decodeValues returns a new list of values each decoded, or values itself without a codec
+func (bst *BST) decodeValues(values [][]byte) [][]byte {
+	if !bst.compressing() || values == nil {
+		return values
+	}
+
+	decoded := make([][]byte, len(values))
+	for i, v := range values {
+		decoded[i] = bst.decode(v)
+	}
+	return decoded
+}
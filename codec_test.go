@@ -0,0 +1,176 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+	"time"
+)
+
+// newFlateCodec creates a flate codec compressing at flate.BestSpeed
+func newFlateCodec(t *testing.T) *FlateCodec {
+	codec, err := NewFlateCodec(flate.BestSpeed)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return codec
+}
+
+func TestFlateCodec(t *testing.T) {
+	codec := newFlateCodec(t)
+	value := bytes.Repeat([]byte("compressible "), 100)
+
+	enc := codec.Compress([]byte("tag"), value)
+	if !bytes.HasPrefix(enc, []byte("tag")) || len(enc) >= len(value) {
+		t.Fatalf("expected a compressed value appended to dst, got %d bytes", len(enc))
+	}
+
+	// Compression must be deterministic
+	if !bytes.Equal(enc, codec.Compress([]byte("tag"), value)) {
+		t.Fatalf("expected compressing twice to give the same bytes")
+	}
+
+	dec, err := codec.Decompress(nil, enc[3:])
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !bytes.Equal(dec, value) {
+		t.Fatalf("expected the value back after decompressing")
+	}
+
+	if _, err := codec.Decompress(nil, []byte("not flate")); err == nil {
+		t.Fatalf("expected an error decompressing invalid input")
+	}
+	for _, level := range []int{-3, 10} {
+		if _, err := NewFlateCodec(level); err != ErrInvalidLevel {
+			t.Fatalf("expected ErrInvalidLevel for level %d, got %v", level, err)
+		}
+	}
+}
+
+func TestBST_CodecDecompressError(t *testing.T) {
+	registry := NewRegistry()
+	bst := New(WithCodec(newFlateCodec(t), 16), WithMetrics(registry))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	// A stored value tagged as compressed which the codec can not decompress
+	if v := bst.decode(append([]byte{compressedValue}, "not flate"...)); v != nil {
+		t.Fatalf("expected a corrupt value to decode as nil, got %q", v)
+	}
+
+	if bst.CompressionStats().Errors != 1 || registry.Counter(MetricDecompressErrors) != 1 {
+		t.Fatalf("expected the failure to be counted")
+	}
+}
+
+func TestBST_Codec(t *testing.T) {
+	bst := New(WithCodec(newFlateCodec(t), 64))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	large := bytes.Repeat([]byte("value "), 100)
+	small := []byte("small")
+
+	bst.Put([]byte("large"), large)
+	bst.Put([]byte("small"), small)
+
+	time.Sleep(10 * time.Millisecond) // wait for the tree to be built
+
+	key := bst.Get([]byte("large"))
+	if key == nil || !bytes.Equal(key.Values[0], large) {
+		t.Fatalf("expected the large value back")
+	}
+
+	key = bst.Get([]byte("small"))
+	if key == nil || !bytes.Equal(key.Values[0], small) {
+		t.Fatalf("expected the small value back")
+	}
+
+	// Only the large value is compressed
+	stats := bst.CompressionStats()
+	if stats.Values != 1 || stats.RawBytes != int64(len(large)) {
+		t.Fatalf("expected 1 value of %d bytes compressed, got %+v", len(large), stats)
+	}
+
+	if stats.Ratio() <= 1 {
+		t.Fatalf("expected a compression ratio above 1, got %f", stats.Ratio())
+	}
+
+	// The tree holds less than the raw values
+	if bst.MemoryStats().Bytes >= int64(len(large)) {
+		t.Fatalf("expected the compressed value to be stored, got %d bytes", bst.MemoryStats().Bytes)
+	}
+
+	keys := bst.Range([]byte("a"), []byte("z"))
+	if len(keys) != 2 || !bytes.Equal(keys[0].Values[0], large) {
+		t.Fatalf("expected range results to be decompressed")
+	}
+}
+
+func TestBST_CodecValueOperations(t *testing.T) {
+	bst := New(WithCodec(newFlateCodec(t), 16), WithValueMode(ValueSet))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	a := bytes.Repeat([]byte("a"), 100)
+	b := bytes.Repeat([]byte("b"), 100)
+
+	bst.PutOffQueue([]byte("key"), a)
+	bst.PutOffQueue([]byte("key"), a)
+	bst.PutOffQueue([]byte("key"), b)
+
+	// Duplicates are found by their compressed form
+	if key := bst.Get([]byte("key")); key == nil || len(key.Values) != 2 {
+		t.Fatalf("expected 2 values in the set")
+	}
+
+	if err := bst.Checked().Remove([]byte("key"), a); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if !bst.CompareAndSwap([]byte("key"), [][]byte{b}, [][]byte{a}) {
+		t.Fatalf("expected the swap to compare decompressed values")
+	}
+
+	prev, _ := bst.Set([]byte("key"), b)
+	if !bytes.Equal(prev, a) {
+		t.Fatalf("expected the previous value decompressed")
+	}
+
+	values, _ := bst.Compute([]byte("key"), func(values [][]byte, exists bool) ([][]byte, bool) {
+		if len(values) != 1 || !bytes.Equal(values[0], b) {
+			t.Errorf("expected Compute to see decompressed values")
+		}
+		return append(values, a), true
+	})
+	if len(values) != 2 {
+		t.Fatalf("expected 2 values, got %d", len(values))
+	}
+
+	if key := bst.Get([]byte("key")); key == nil || !bytes.Equal(key.Values[1], a) {
+		t.Fatalf("expected the computed values back")
+	}
+}
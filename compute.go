@@ -0,0 +1,98 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"time"
+)
+
+// ComputeFunc computes the new values of a key from its current values.  exists is false if
+// the key does not exist.  Returning keep false deletes the key, or leaves it absent.
+type ComputeFunc func(old [][]byte, exists bool) (values [][]byte, keep bool)
+
+// Compute atomically replaces the values of a key with the result of fn, creating or deleting
+// the key as needed.  fn is called by the key's writer with the key latch held so it must not call
+// back into the tree, and it may be called more than once if the key is concurrently created or
+// deleted, only the result of the last call is applied.  It is queued behind earlier writes to the
+// key and waits for them, returning the new values and whether the key exists afterwards.  The new values
+// are stored as the tree's ValueMode holds them, only the last is kept in ValueMap.
+func (bst *BST) Compute(key []byte, fn ComputeFunc) ([][]byte, bool) {
+	op := &Operation{Type: OpCompute, Key: key, compute: fn}
+	if bst.applyQueued(op) != nil {
+		return nil, false
+	}
+	return op.values, op.ok
+}
+
+// computeOffQueue replaces the values of a key with the result of fn
+func (bst *BST) computeOffQueue(key []byte, fn ComputeFunc) ([][]byte, bool) {
+	for {
+		k := bst.find(key)
+		if k == nil {
+			values, keep := fn(nil, false)
+			if !keep {
+				return nil, false
+			}
+			values = normalize(values, bst.ValueMode)
+
+			// Link a new node unless the key has been created since, in which case compute again
+			create := func() *Key {
+				k := bst.newKey(bst.keep(key))
+				k.setValues(bst.keepValues(values), nil)
+				return k
+			}
+			if bst.upsert(key, create, func(*Key) {}) {
+				bst.incr(MetricPuts, 1)
+				bst.notifyValues(key, values)
+				return values, true
+			}
+			continue
+		}
+
+		k.Latch.Lock()
+		if k.deleted {
+			// The key is being unlinked, look it up again
+			k.Latch.Unlock()
+			continue
+		}
+
+		values, keep := fn(bst.decodeValues(k.load().liveValues(time.Now().UnixNano())), true)
+		if keep {
+			values = normalize(values, bst.ValueMode)
+			size := k.size
+			k.setValues(bst.keepValues(values), nil)
+			bst.accessed(k)
+			bst.account(k.size - size)
+			k.Latch.Unlock()
+			bst.evict()
+
+			bst.incr(MetricPuts, 1)
+			bst.notifyValues(key, values)
+			return values, true
+		}
+
+		// Mark the key deleted before releasing the latch so no writer can update it, then unlink it
+		k.deleted = true
+		k.Latch.Unlock()
+
+		bst.incr(MetricDeletes, 1)
+		bst.deleteKey(key, func(existing *Key) bool {
+			return existing == k
+		})
+		return nil, false
+	}
+}
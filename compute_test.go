@@ -0,0 +1,120 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestBST_Compute(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	values, ok := bst.Compute([]byte("key"), func(old [][]byte, exists bool) ([][]byte, bool) {
+		if exists {
+			t.Fatal("expected key to not exist")
+		}
+		return [][]byte{[]byte("a")}, true
+	})
+	if !ok || len(values) != 1 {
+		t.Fatal("expected key to be created")
+	}
+
+	bst.Compute([]byte("key"), func(old [][]byte, exists bool) ([][]byte, bool) {
+		return append(old, []byte("b")), true
+	})
+
+	key := bst.Get([]byte("key"))
+	if len(key.Values) != 2 || string(key.Values[1]) != "b" {
+		t.Fatal("expected values a and b")
+	}
+
+	_, ok = bst.Compute([]byte("key"), func(old [][]byte, exists bool) ([][]byte, bool) {
+		return nil, false
+	})
+	if ok {
+		t.Fatal("expected key to be deleted")
+	}
+
+	if bst.Get([]byte("key")) != nil {
+		t.Fatal("expected key to be deleted")
+	}
+
+	_, ok = bst.Compute([]byte("missing"), func(old [][]byte, exists bool) ([][]byte, bool) {
+		return nil, false
+	})
+	if ok || bst.Get([]byte("missing")) != nil {
+		t.Fatal("expected missing key to stay absent")
+	}
+}
+
+func TestBST_ConcurrentCompute(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	increment := func(old [][]byte, exists bool) ([][]byte, bool) {
+		n := 0
+		if exists {
+			n, _ = strconv.Atoi(string(old[0]))
+		}
+		return [][]byte{[]byte(strconv.Itoa(n + 1))}, true
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				bst.Compute([]byte("counter"), increment)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if v := string(bst.Get([]byte("counter")).Values[0]); v != "1000" {
+		t.Fatalf("expected counter to be 1000, got %s", v)
+	}
+}
+
+func TestBST_ComputeValueMode(t *testing.T) {
+	bst := New(WithValueMode(ValueMap))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	values, ok := bst.Compute([]byte("key"), func(old [][]byte, exists bool) ([][]byte, bool) {
+		return [][]byte{[]byte("a"), []byte("b")}, true
+	})
+	if !ok || len(values) != 1 || string(values[0]) != "b" {
+		t.Fatalf("expected only the last value to be kept, got %q", values)
+	}
+
+	if key := bst.Get([]byte("key")); key == nil || len(key.Values) != 1 {
+		t.Fatal("expected a single value")
+	}
+}
@@ -0,0 +1,44 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import "context"
+
+// PutContext queues a value to be added to a key, returning ctx's error without writing if ctx is done
+// before the write is queued or ErrClosed if the tree is closed.  With a bounded write queue and
+// QueueBlock it waits for space until ctx is done, with QueueFail it returns ErrQueueFull.
+func (bst *BST) PutContext(ctx context.Context, key, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if bst.closed() {
+		return ErrClosed
+	}
+
+	return bst.enqueue(ctx, bst.putOperation(OpPut, key, value, 0))
+}
+
+// cancelled checks if done has been closed, a nil done is never cancelled
+func cancelled(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,97 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBST_RangeContext(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	for i := 0; i < 10; i++ {
+		bst.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("value"))
+	}
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	keys, err := bst.RangeContext(context.Background(), []byte("key02"), []byte("key05"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 4 {
+		t.Fatalf("expected 4 keys, got %d", len(keys))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	queries := []func() ([]*Key, error){
+		func() ([]*Key, error) { return bst.RangeContext(ctx, []byte("key02"), []byte("key05")) },
+		func() ([]*Key, error) { return bst.GreaterThanContext(ctx, []byte("key02")) },
+		func() ([]*Key, error) { return bst.GreaterThanEqContext(ctx, []byte("key02")) },
+		func() ([]*Key, error) { return bst.LessThanContext(ctx, []byte("key02")) },
+		func() ([]*Key, error) { return bst.LessThanEqContext(ctx, []byte("key02")) },
+		func() ([]*Key, error) { return bst.NGetContext(ctx, []byte("key02")) },
+	}
+
+	for _, query := range queries {
+		keys, err := query()
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+
+		if keys != nil {
+			t.Fatal("expected no keys")
+		}
+	}
+}
+
+func TestBST_PutContext(t *testing.T) {
+	bst := New()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := bst.PutContext(ctx, []byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if err := bst.PutContext(ctx, []byte("key2"), []byte("value")); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	if bst.Get([]byte("key")) == nil || bst.Get([]byte("key2")) != nil {
+		t.Fatal("expected only key to be written")
+	}
+
+	bst.Close()
+	if err := bst.PutContext(context.Background(), []byte("key"), []byte("value")); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import "time"
+
+// WithZeroCopy stores the key and value slices passed to writes as is rather than copies.
+// The caller must not change them afterwards, including while a write is queued.
+func WithZeroCopy() Option {
+	return func(bst *BST) {
+		bst.ZeroCopy = true
+	}
+}
+
+// WithBorrowedReads returns keys sharing the tree's own key and value slices from Get and range queries
+// rather than copies.  The caller must not change them.
+func WithBorrowedReads() Option {
+	return func(bst *BST) {
+		bst.BorrowedReads = true
+	}
+}
+
+// own returns a copy of b the caller can not change, or b itself with ZeroCopy
+func (bst *BST) own(b []byte) []byte {
+	if bst.ZeroCopy || b == nil {
+		return b
+	}
+	return append(make([]byte, 0, len(b)), b...)
+}
+
+// ownPair returns copies of key and value sharing a single allocation, or both as is with ZeroCopy
+func (bst *BST) ownPair(key, value []byte) ([]byte, []byte) {
+	// A compressed key is replaced by its suffix, the value must not keep the full key alive
+	if bst.ZeroCopy || bst.PrefixCompression || key == nil || value == nil {
+		return bst.own(key), bst.own(value)
+	}
+
+	buf := make([]byte, 0, len(key)+len(value))
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+	return buf[:len(key):len(key)], buf[len(key):len(buf):len(buf)]
+}
+
+// keep returns b as stored by a write applied immediately, as is with an arena which copies it once stored
+func (bst *BST) keep(b []byte) []byte {
+	if bst.Arena != nil {
+		return b
+	}
+	return bst.own(b)
+}
+
+// keepValue returns a value as stored by a write applied immediately, encoded by the codec if there is one
+func (bst *BST) keepValue(v []byte) []byte {
+	if bst.compressing() && v != nil {
+		return bst.encode(v)
+	}
+	return bst.keep(v)
+}
+
+// keepValues returns a new list of values each kept as by keepValue
+func (bst *BST) keepValues(values [][]byte) [][]byte {
+	if len(values) == 0 {
+		return nil
+	}
+
+	kept := make([][]byte, len(values))
+	for i, v := range values {
+		kept[i] = bst.keepValue(v)
+	}
+	return kept
+}
+
+// view returns a copy of key with the values live at now, nil if all of them expired.  The values are
+// loaded from the key's published state without the latch.  With BorrowedReads the copy shares the
+// tree's slices unless its key or values are compressed.
+func (bst *BST) view(key *Key, now int64) *Key {
+	if key == nil {
+		return nil
+	}
+
+	s := key.load().live(now)
+	if s == nil {
+		return nil
+	}
+
+	if bst.BorrowedReads && key.prefix == nil && !bst.compressing() {
+		return &Key{K: key.stored(), Values: s.list(), Expires: s.expires[:len(s.expires):len(s.expires)], Latch: key.Latch}
+	}
+
+	// Copy the key and its decoded values into a single buffer
+	values := bst.decodeValues(s.list())
+	n := key.length()
+	size := n
+	for _, v := range values {
+		size += len(v)
+	}
+	buf := make([]byte, 0, size)
+
+	c := newKey(nil)
+	buf = key.appendTo(buf)
+	c.K = buf[:n:n]
+
+	c.Values = make([][]byte, len(values))
+	for i, v := range values {
+		start := len(buf)
+		buf = append(buf, v...)
+		c.Values[i] = buf[start:len(buf):len(buf)]
+	}
+
+	if s.expires != nil {
+		c.Expires = append([]int64(nil), s.expires...)
+	}
+	return c
+}
+
+// views records an access of each key and copies it as by view, leaving out keys whose values all expired
+func (bst *BST) views(keys []*Key) []*Key {
+	now := time.Now().UnixNano()
+	live := keys[:0]
+	for _, key := range keys {
+		bst.accessed(key)
+		if key = bst.view(key, now); key != nil {
+			live = append(live, key)
+		}
+	}
+	return live
+}
+
+// putOperation returns a queued write owning its key and value
+func (bst *BST) putOperation(typ OperationType, key, value []byte, expires int64) *Operation {
+	key, value = bst.ownPair(key, value)
+	return newOperation(typ, key, value, expires)
+}
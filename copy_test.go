@@ -0,0 +1,164 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBST_CopyOnPut(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	// Reuse one buffer for every write as a reader filling it from the network would
+	buf := []byte("key0")
+	for i := 0; i < 10; i++ {
+		buf[3] = byte('0' + i)
+		bst.Put(buf, buf)
+	}
+
+	buf[3] = 'x'
+	bst.Set(buf, buf)
+	buf[3] = 'y'
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	keys := bst.Range([]byte("key0"), []byte("key9"))
+	if len(keys) != 10 {
+		t.Fatalf("expected 10 keys, got %d", len(keys))
+	}
+
+	for i, key := range keys {
+		if key.K[3] != byte('0'+i) || key.Values[0][3] != byte('0'+i) {
+			t.Fatalf("expected key%d, got %s %s", i, key.K, key.Values[0])
+		}
+	}
+
+	if key := bst.Get([]byte("keyx")); key == nil || string(key.Values[0]) != "keyx" {
+		t.Fatal("expected keyx to be set")
+	}
+}
+
+func TestBST_CopyOnRead(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.Put([]byte("key"), []byte("value"))
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	// Changing a returned key does not change the tree
+	key := bst.Get([]byte("key"))
+	key.K[0] = 'x'
+	key.Values[0][0] = 'x'
+	key.Values = append(key.Values, []byte("value 2"))
+
+	key = bst.Get([]byte("key"))
+	if key == nil || len(key.Values) != 1 || string(key.Values[0]) != "value" {
+		t.Fatalf("expected key to be unchanged, got %v", key)
+	}
+
+	keys := bst.Range([]byte("a"), []byte("z"))
+	keys[0].Values[0][0] = 'x'
+	if string(bst.Get([]byte("key")).Values[0]) != "value" {
+		t.Fatal("expected range results to be copies")
+	}
+}
+
+func TestBST_ZeroCopy(t *testing.T) {
+	bst := New(WithZeroCopy(), WithBorrowedReads())
+
+	defer func() {
+		bst.Close()
+	}()
+
+	key, value := []byte("key"), []byte("value")
+	bst.PutOffQueue(key, value)
+
+	// The tree holds and returns the caller's slices
+	k := bst.Get(key)
+	if &k.K[0] != &key[0] || &k.Values[0][0] != &value[0] {
+		t.Fatal("expected the caller's slices to be stored as is")
+	}
+
+	if k = bst.Get(key); &k.K[0] != &key[0] || &k.Values[0][0] != &value[0] {
+		t.Fatal("expected the tree's own slices to be returned")
+	}
+}
+
+func TestBST_ConcurrentReads(t *testing.T) {
+	bst := New(WithValueMode(ValueSortedSet), WithBorrowedReads())
+
+	defer func() {
+		bst.Close()
+	}()
+
+	key := []byte("key")
+	expires := time.Now().Add(time.Hour).UnixNano()
+	atomic.StoreInt32(&bst.ttl, 1)
+
+	// Shift, remove and expire values of a single key while it is read
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			value := []byte(fmt.Sprintf("value%02d", (i*7)%50))
+			bst.putOffQueue(key, value, expires*int64(i%2))
+			if i%3 == 0 {
+				bst.removeOffQueue(key, value)
+			}
+		}
+	}()
+
+	check := func(k *Key) {
+		for i := 1; i < len(k.Values); i++ {
+			if bytes.Compare(k.Values[i-1], k.Values[i]) >= 0 {
+				t.Fatalf("expected sorted values, got %s before %s", k.Values[i-1], k.Values[i])
+			}
+		}
+		if k.Expires != nil && len(k.Expires) != len(k.Values) {
+			t.Fatalf("expected %d expiries, got %d", len(k.Values), len(k.Expires))
+		}
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		if k := bst.Get(key); k != nil {
+			check(k)
+		}
+		for _, k := range bst.Range(key, key) {
+			check(k)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// KeyProvider supplies the AES keys, 16, 24 or 32 bytes, encrypting exports.  Exports are sealed with
+// the current key and name it by id, so a key must stay available by id while files sealed with it exist.
+type KeyProvider interface {
+	CurrentKey() (id string, key []byte, err error) // CurrentKey returns the key to seal new exports with
+	Key(id string) ([]byte, error)                  // Key returns a key by id to open an export
+}
+
+// WithEncryption seals NDJSON exports with AES-GCM using keys from provider, imports must then be sealed.
+// MarshalJSON and UnmarshalJSON are not sealed and always write and read plaintext.
+func WithEncryption(provider KeyProvider) Option {
+	return func(bst *BST) {
+		bst.Encryption = provider
+	}
+}
+
+// KeyRing is a KeyProvider holding keys in memory.  Rotate makes a new key current while older keys
+// still open exports sealed with them, the next export rewrites the data under the new key.
+type KeyRing struct {
+	lock    sync.RWMutex      // Lock for the keys
+	current string            // Id of the current key
+	keys    map[string][]byte // Keys by id
+}
+
+// NewKeyRing creates a key ring whose current key is key
+func NewKeyRing(id string, key []byte) *KeyRing {
+	r := &KeyRing{keys: make(map[string][]byte)}
+	r.Rotate(id, key)
+	return r
+}
+
+// Rotate adds a key and makes it current
+func (r *KeyRing) Rotate(id string, key []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.keys[id] = append([]byte(nil), key...)
+	r.current = id
+}
+
+// CurrentKey returns the key to seal new exports with
+func (r *KeyRing) CurrentKey() (string, []byte, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.current, r.keys[r.current], nil
+}
+
+// Key returns a key by id, ErrUnknownKey if the ring does not hold it
+func (r *KeyRing) Key(id string) ([]byte, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	key, ok := r.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// envelope is a sealed NDJSON line, a record or the trailer ending the export
+type envelope struct {
+	Export []byte `json:"export"`        // Random id of the export, the same on every line
+	KeyID  string `json:"kid"`           // Id of the key the line is sealed with
+	Seq    uint64 `json:"seq"`           // Position of the line within the export
+	End    bool   `json:"end,omitempty"` // Whether the line is the trailer, without it the export was truncated
+	Data   []byte `json:"data"`          // Nonce followed by the sealed record
+}
+
+// sealer seals the lines of an export with a single key
+type sealer struct {
+	export []byte      // Random id of the export
+	id     string      // Id of the key
+	aead   cipher.AEAD // AES-GCM with the key
+	seq    uint64      // Position of the next line
+}
+
+// newAEAD returns AES-GCM with key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newSealer returns a sealer using the provider's current key
+func (bst *BST) newSealer() (*sealer, error) {
+	id, key, err := bst.Encryption.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	export := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, export); err != nil {
+		return nil, err
+	}
+	return &sealer{export: export, id: id, aead: aead}, nil
+}
+
+// additionalData binds a line to its export, key, position and whether it is the trailer
+func additionalData(export []byte, id string, seq uint64, end bool) []byte {
+	ad := append(make([]byte, 0, len(export)+9+len(id)), export...)
+	ad = binary.BigEndian.AppendUint64(ad, seq)
+	if end {
+		ad = append(ad, 1)
+	} else {
+		ad = append(ad, 0)
+	}
+	return append(ad, id...)
+}
+
+// seal returns the next line of the export holding plaintext
+func (s *sealer) seal(plaintext []byte, end bool) (envelope, error) {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plaintext)+s.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return envelope{}, err
+	}
+
+	env := envelope{Export: s.export, KeyID: s.id, Seq: s.seq, End: end}
+	env.Data = s.aead.Seal(nonce, nonce, plaintext, additionalData(s.export, s.id, s.seq, end))
+	s.seq++
+	return env, nil
+}
+
+// writeRecord writes a record as a line of an export, sealed if s is not nil
+func writeRecord(encoder *json.Encoder, s *sealer, r record) error {
+	if s == nil {
+		return encoder.Encode(r)
+	}
+
+	plaintext, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	env, err := s.seal(plaintext, false)
+	if err != nil {
+		return err
+	}
+	return encoder.Encode(env)
+}
+
+// writeTrailer ends a sealed export
+func writeTrailer(encoder *json.Encoder, s *sealer) error {
+	env, err := s.seal(nil, true)
+	if err != nil {
+		return err
+	}
+	return encoder.Encode(env)
+}
+
+// opener opens the lines of a sealed export in order
+type opener struct {
+	provider KeyProvider            // Provider of the keys
+	aeads    map[string]cipher.AEAD // AES-GCM by key id
+	export   []byte                 // Id of the export, taken from its first line
+	seq      uint64                 // Position of the next line
+}
+
+// open returns the plaintext of the next line, ErrTampered if it was changed, reordered, taken from
+// another export or not sealed
+func (o *opener) open(env envelope) ([]byte, error) {
+	if env.KeyID == "" || len(env.Export) == 0 || env.Seq != o.seq {
+		return nil, ErrTampered
+	}
+
+	if o.export == nil {
+		o.export = env.Export
+	} else if !bytes.Equal(env.Export, o.export) {
+		return nil, ErrTampered
+	}
+
+	aead, ok := o.aeads[env.KeyID]
+	if !ok {
+		key, err := o.provider.Key(env.KeyID)
+		if err != nil {
+			return nil, err
+		}
+
+		if aead, err = newAEAD(key); err != nil {
+			return nil, err
+		}
+		o.aeads[env.KeyID] = aead
+	}
+
+	if len(env.Data) < aead.NonceSize() {
+		return nil, ErrTampered
+	}
+
+	nonce, sealed := env.Data[:aead.NonceSize()], env.Data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, additionalData(env.Export, env.KeyID, env.Seq, env.End))
+	if err != nil {
+		return nil, ErrTampered
+	}
+
+	o.seq++
+	return plaintext, nil
+}
+
+// importSealed reads a sealed export, writing its records to the tree only once all of them and
+// the trailer have been verified
+func (bst *BST) importSealed(decoder *json.Decoder) error {
+	o := &opener{provider: bst.Encryption, aeads: make(map[string]cipher.AEAD)}
+
+	var records []record
+	for {
+		var env envelope
+		if err := decoder.Decode(&env); err == io.EOF {
+			// The trailer is missing, the export was truncated
+			return ErrTampered
+		} else if err != nil {
+			return err
+		}
+
+		plaintext, err := o.open(env)
+		if err != nil {
+			return err
+		}
+
+		if env.End {
+			break
+		}
+
+		var r record
+		if err := json.Unmarshal(plaintext, &r); err != nil {
+			return err
+		}
+		records = append(records, r)
+	}
+
+	// Nothing may follow the trailer
+	var extra json.RawMessage
+	if err := decoder.Decode(&extra); err != io.EOF {
+		return ErrTampered
+	}
+
+	return bst.putBalanced(records)
+}
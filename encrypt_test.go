@@ -0,0 +1,158 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sealedExport returns an export of three keys sealed with ring
+func sealedExport(t *testing.T, ring *KeyRing) []byte {
+	bst := New(WithEncryption(ring), WithEncoding(StringEncoding))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.Put([]byte("b"), []byte("secret-2"))
+	bst.Put([]byte("a"), []byte("secret-1"))
+	bst.Put([]byte("c"), []byte("secret-3"))
+
+	time.Sleep(10 * time.Millisecond) // wait for the tree to be built
+
+	var buf bytes.Buffer
+	if err := bst.ExportNDJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBST_EncryptedNDJSON(t *testing.T) {
+	ring := NewKeyRing("k1", bytes.Repeat([]byte{1}, 32))
+	data := sealedExport(t, ring)
+
+	if bytes.Contains(data, []byte("secret")) {
+		t.Fatalf("expected no plaintext values in the export")
+	}
+
+	// Three records and the trailer
+	if n := bytes.Count(data, []byte("\n")); n != 4 {
+		t.Fatalf("expected 4 lines, got %d", n)
+	}
+
+	bst := New(WithEncryption(ring), WithEncoding(StringEncoding))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	if err := bst.ImportNDJSON(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := bst.Range([]byte("a"), []byte("c"))
+	if len(keys) != 3 || string(keys[1].Values[0]) != "secret-2" {
+		t.Fatalf("expected the keys back")
+	}
+}
+
+func TestBST_EncryptedNDJSONTampered(t *testing.T) {
+	ring := NewKeyRing("k1", bytes.Repeat([]byte{1}, 32))
+	data := sealedExport(t, ring)
+	lines := strings.SplitAfter(string(data), "\n")
+	other := strings.SplitAfter(string(sealedExport(t, ring)), "\n")
+
+	flipped := []byte(data)
+	i := bytes.Index(flipped, []byte(`"data":"`)) + len(`"data":"`) + 20
+	if flipped[i] == 'A' {
+		flipped[i] = 'B'
+	} else {
+		flipped[i] = 'A'
+	}
+
+	inputs := map[string]string{
+		"flipped":         string(flipped),
+		"truncated":       strings.Join(lines[:3], ""),
+		"reordered":       lines[1] + lines[0] + lines[2] + lines[3],
+		"dropped":         lines[0] + lines[2] + lines[3],
+		"appended":        string(data) + lines[0],
+		"plaintext":       `{"key":"a","values":["1"]}` + "\n",
+		"spliced trailer": lines[0] + lines[1] + lines[2] + other[3],
+		"spliced line":    lines[0] + other[1] + lines[2] + lines[3],
+	}
+
+	for name, input := range inputs {
+		bst := New(WithEncryption(ring))
+
+		err := bst.ImportNDJSON(strings.NewReader(input))
+		if err != ErrTampered {
+			t.Errorf("%s: expected ErrTampered, got %v", name, err)
+		}
+
+		// Nothing is written from tampered input
+		if len(bst.Range([]byte("a"), []byte("z"))) != 0 {
+			t.Errorf("%s: expected no keys to be written", name)
+		}
+		bst.Close()
+	}
+}
+
+func TestBST_EncryptedNDJSONRotation(t *testing.T) {
+	ring := NewKeyRing("k1", bytes.Repeat([]byte{1}, 32))
+	old := sealedExport(t, ring)
+
+	ring.Rotate("k2", bytes.Repeat([]byte{2}, 32))
+
+	bst := New(WithEncryption(ring), WithEncoding(StringEncoding))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	// Exports sealed with the old key still open
+	if err := bst.ImportNDJSON(bytes.NewReader(old)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next export is rewritten under the new key
+	var buf bytes.Buffer
+	if err := bst.ExportNDJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(buf.Bytes(), []byte(`"kid":"k1"`)) || !bytes.Contains(buf.Bytes(), []byte(`"kid":"k2"`)) {
+		t.Fatalf("expected the export to be sealed with the new key")
+	}
+
+	// A ring without the old key can not open the old export
+	other := New(WithEncryption(NewKeyRing("k2", bytes.Repeat([]byte{2}, 32))), WithEncoding(StringEncoding))
+
+	defer func() {
+		other.Close()
+	}()
+
+	if err := other.ImportNDJSON(bytes.NewReader(old)); err != ErrUnknownKey {
+		t.Fatalf("expected ErrUnknownKey, got %v", err)
+	}
+
+	if err := other.ImportNDJSON(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+}
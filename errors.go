@@ -0,0 +1,137 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrKeyNotFound     = errors.New("bst: key not found")                       // The key does not exist
+	ErrValueNotFound   = errors.New("bst: value not found")                     // The key does not hold the value
+	ErrClosed          = errors.New("bst: tree is closed")                      // The tree has been closed
+	ErrKeyTooLarge     = errors.New("bst: key too large")                       // The key is larger than the tree's MaxKeySize
+	ErrNoMergeOperator = errors.New("bst: no merge operator")                   // Merge was called on a tree without a merge operator
+	ErrQueueFull       = errors.New("bst: write queue full")                    // The write queue is full and the tree's QueuePolicy is QueueFail
+	ErrTampered        = errors.New("bst: sealed input has been tampered with") // A sealed import failed authentication, was truncated or reordered
+	ErrUnknownKey      = errors.New("bst: unknown encryption key")              // The key provider does not hold the key an import was sealed with
+	ErrInvalidRecord   = errors.New("bst: invalid record")                      // An imported record's expiries do not match its values
+	ErrInvalidLevel    = errors.New("bst: invalid compression level")           // The compression level is not one the codec supports
+)
+
+// WithMaxKeySize sets the largest key in bytes the Checked API accepts, 0 for no limit
+func WithMaxKeySize(n int) Option {
+	return func(bst *BST) {
+		bst.MaxKeySize = n
+	}
+}
+
+// Checked is a view of a BST whose methods report failures as errors
+type Checked struct {
+	bst *BST
+}
+
+// Checked returns a view of the tree whose methods report failures as errors
+func (bst *BST) Checked() *Checked {
+	return &Checked{bst: bst}
+}
+
+// check validates the tree is open and the key is within the size limit
+func (c *Checked) check(key []byte) error {
+	if c.bst.closed() {
+		return ErrClosed
+	}
+
+	if c.bst.MaxKeySize > 0 && len(key) > c.bst.MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	return nil
+}
+
+// Get retrieves a key, returning ErrKeyNotFound if it does not exist
+func (c *Checked) Get(key []byte) (*Key, error) {
+	if c.bst.closed() {
+		return nil, ErrClosed
+	}
+
+	k := c.bst.Get(key)
+	if k == nil {
+		return nil, ErrKeyNotFound
+	}
+	return k, nil
+}
+
+// Put queues a value to be added to a key
+func (c *Checked) Put(key, value []byte) error {
+	if err := c.check(key); err != nil {
+		return err
+	}
+
+	return c.bst.enqueue(context.Background(), c.bst.putOperation(OpPut, key, value, 0))
+}
+
+// PutWithTTL queues a value which expires after ttl to be added to a key
+func (c *Checked) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	if err := c.check(key); err != nil {
+		return err
+	}
+
+	return c.bst.putWithTTL(context.Background(), key, value, ttl)
+}
+
+// Set replaces the values of a key with a single value, returning the previous value, nil if there was none.
+// It returns ErrQueueFull or ErrClosed if the write could not be queued.
+func (c *Checked) Set(key, value []byte) ([]byte, error) {
+	if err := c.check(key); err != nil {
+		return nil, err
+	}
+
+	op := &Operation{Type: OpSet, Key: key, Value: value}
+	if err := c.bst.applyQueued(op); err != nil {
+		return nil, err
+	}
+	return op.prev, nil
+}
+
+// Merge queues an operand to be merged into a key's values
+func (c *Checked) Merge(key, operand []byte) error {
+	if err := c.check(key); err != nil {
+		return err
+	}
+
+	return c.bst.Merge(key, operand)
+}
+
+// Remove removes a value from a key, returning ErrKeyNotFound or ErrValueNotFound if there was nothing to remove
+func (c *Checked) Remove(key, value []byte) error {
+	if c.bst.closed() {
+		return ErrClosed
+	}
+
+	return c.bst.removeValue(key, value)
+}
+
+// Delete removes a key, returning ErrKeyNotFound if it does not exist
+func (c *Checked) Delete(key []byte) error {
+	if c.bst.closed() {
+		return ErrClosed
+	}
+
+	return c.bst.deleteQueued(key)
+}
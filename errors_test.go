@@ -0,0 +1,121 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBST_RemoveDeleteResult(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.Put([]byte("key"), []byte("value"))
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	if bst.Remove([]byte("key"), []byte("other")) {
+		t.Fatal("expected remove of missing value to report nothing removed")
+	}
+
+	if !bst.Remove([]byte("key"), []byte("value")) {
+		t.Fatal("expected remove to report the value removed")
+	}
+
+	if !bst.Delete([]byte("key")) {
+		t.Fatal("expected delete to report the key removed")
+	}
+
+	if bst.Delete([]byte("key")) {
+		t.Fatal("expected delete of missing key to report nothing removed")
+	}
+}
+
+func TestChecked(t *testing.T) {
+	bst := New(WithMaxKeySize(4))
+	checked := bst.Checked()
+
+	if err := checked.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checked.Put([]byte("key12"), []byte("value")); err != ErrKeyTooLarge {
+		t.Fatalf("expected ErrKeyTooLarge, got %v", err)
+	}
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := checked.Get([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := checked.Get([]byte("nope")); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	if err := checked.Remove([]byte("key"), []byte("other")); err != ErrValueNotFound {
+		t.Fatalf("expected ErrValueNotFound, got %v", err)
+	}
+
+	if err := checked.Remove([]byte("nope"), []byte("value")); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	if err := checked.Merge([]byte("key"), []byte("value")); err != ErrNoMergeOperator {
+		t.Fatalf("expected ErrNoMergeOperator, got %v", err)
+	}
+
+	if err := checked.Delete([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checked.Delete([]byte("key")); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	bst.Close()
+
+	if err := checked.Put([]byte("key"), []byte("value")); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+
+	if _, err := checked.Get([]byte("key")); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestChecked_SetQueueFull(t *testing.T) {
+	bst := newStalledBST(WithQueueCapacity(1, QueueFail))
+	checked := bst.Checked()
+
+	bst.Put([]byte("key"), []byte("value"))
+
+	if prev, err := checked.Set([]byte("key"), []byte("value 2")); err != ErrQueueFull || prev != nil {
+		t.Fatalf("expected ErrQueueFull, got %q, %v", prev, err)
+	}
+
+	bst.writeNext(bst.writers[0])
+	if key := bst.Get([]byte("key")); key == nil || len(key.Values) != 1 || string(key.Values[0]) != "value" {
+		t.Fatal("expected the set to have been dropped")
+	}
+}
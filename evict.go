@@ -0,0 +1,222 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"container/heap"
+	"sync/atomic"
+	"time"
+)
+
+// EvictionPolicy is how keys are chosen for eviction once the tree is over its memory limit
+type EvictionPolicy int
+
+const (
+	EvictLRU EvictionPolicy = iota // Evict the least recently accessed keys
+	EvictLFU                       // Evict the least frequently accessed keys
+)
+
+// Metric names reported by eviction
+const (
+	MetricBytes          = "bst_bytes"                // Bytes of keys and values within the tree
+	MetricEvictions      = "bst_evictions_total"      // Keys evicted to stay within the memory limit
+	MetricEvictedBytes   = "bst_evicted_bytes_total"  // Bytes of keys and values evicted
+	MetricEvictionsScans = "bst_eviction_scans_total" // Scans of the tree for keys to evict
+)
+
+// EvictFunc is called with each evicted key and its values
+type EvictFunc func(key []byte, values [][]byte)
+
+// MemoryStats are the tree's memory use and evictions
+type MemoryStats struct {
+	Bytes        int64 // Bytes of keys and values within the tree
+	Keys         int64 // Keys within the tree
+	Evictions    int64 // Keys evicted
+	EvictedBytes int64 // Bytes of keys and values evicted
+}
+
+// WithMemoryLimit bounds the tree to maxBytes bytes of keys and values and maxKeys keys, 0 for no
+// bound.  Once a write takes the tree over a bound, keys are evicted according to policy until it
+// is back under 90% of the bound.
+func WithMemoryLimit(maxBytes, maxKeys int64, policy EvictionPolicy) Option {
+	return func(bst *BST) {
+		bst.MaxBytes = maxBytes
+		bst.MaxKeys = maxKeys
+		bst.EvictionPolicy = policy
+	}
+}
+
+// WithEvictionCallback calls fn with each key evicted to stay within the memory limit.  It is
+// called from the writer that went over the limit so it must not write to the tree.
+func WithEvictionCallback(fn EvictFunc) Option {
+	return func(bst *BST) {
+		bst.OnEvict = fn
+	}
+}
+
+// MemoryStats returns the tree's memory use and evictions
+func (bst *BST) MemoryStats() MemoryStats {
+	return MemoryStats{
+		Bytes:        atomic.LoadInt64(&bst.bytes),
+		Keys:         atomic.LoadInt64(&bst.nodes),
+		Evictions:    atomic.LoadInt64(&bst.evictions),
+		EvictedBytes: atomic.LoadInt64(&bst.evictedBytes),
+	}
+}
+
+// limited checks if the tree has a memory limit
+func (bst *BST) limited() bool {
+	return bst.MaxBytes > 0 || bst.MaxKeys > 0
+}
+
+// account adds delta to the bytes of keys and values within the tree
+func (bst *BST) account(delta int64) {
+	if delta != 0 {
+		bst.gauge(MetricBytes, atomic.AddInt64(&bst.bytes, delta))
+	}
+}
+
+// added accounts for a key linked into the tree
+func (bst *BST) added(key *Key) {
+	bst.gauge(MetricNodes, atomic.AddInt64(&bst.nodes, 1))
+	bst.account(key.size)
+	bst.accessed(key)
+}
+
+// accessed records an access of key for eviction.  It only uses atomics on the key so concurrent
+// readers are never serialized.
+func (bst *BST) accessed(key *Key) {
+	if key == nil || !bst.limited() {
+		return
+	}
+
+	atomic.StoreInt64(&key.accessed, int64(time.Since(bst.started)))
+	atomic.AddUint32(&key.hits, 1)
+}
+
+// over checks if the tree is over a bound scaled by num/den
+func (bst *BST) over(num, den int64) bool {
+	return (bst.MaxBytes > 0 && atomic.LoadInt64(&bst.bytes)*den > bst.MaxBytes*num) ||
+		(bst.MaxKeys > 0 && atomic.LoadInt64(&bst.nodes)*den > bst.MaxKeys*num)
+}
+
+// evict evicts keys once the tree is over its memory limit until it is under 90% of it.
+// A single writer evicts at a time, others carry on over the limit meanwhile.
+func (bst *BST) evict() {
+	if !bst.limited() || !bst.over(1, 1) || !atomic.CompareAndSwapInt32(&bst.evicting, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&bst.evicting, 0)
+
+	for bst.over(9, 10) {
+		// Each scan collects a tenth of the keys as candidates, or all of them for small trees
+		n := int(atomic.LoadInt64(&bst.nodes) / 10)
+		if n < 16 {
+			n = 16
+		}
+
+		// Stop if no candidate could be evicted, they were all replaced or deleted meanwhile
+		evicted := false
+		candidates := bst.candidates(n)
+		for len(candidates) > 0 && bst.over(9, 10) {
+			if bst.evictKey(heap.Pop(&candidates).(candidate).key) {
+				evicted = true
+			}
+		}
+
+		if !evicted {
+			return
+		}
+	}
+}
+
+// evictKey deletes key if it has not been replaced, calling OnEvict with it.  Returns whether it was evicted.
+func (bst *BST) evictKey(key *Key) bool {
+	var values [][]byte
+	var size int64
+
+	name := key.bytes()
+	evicted := bst.deleteKey(name, func(k *Key) bool {
+		values, size = k.load().list(), k.size
+		return k == key
+	})
+	if !evicted {
+		return false
+	}
+
+	atomic.AddInt64(&bst.evictions, 1)
+	atomic.AddInt64(&bst.evictedBytes, size)
+	bst.incr(MetricEvictions, 1)
+	bst.incr(MetricEvictedBytes, size)
+
+	if bst.OnEvict != nil {
+		bst.OnEvict(name, bst.decodeValues(values))
+	}
+	return true
+}
+
+// candidate is a key which may be evicted, lower scores are evicted first
+type candidate struct {
+	key   *Key
+	score int64
+}
+
+// candidates is a heap of eviction candidates
+type candidates []candidate
+
+func (c candidates) Len() int            { return len(c) }
+func (c candidates) Less(i, j int) bool  { return c[i].score < c[j].score }
+func (c candidates) Swap(i, j int)       { c[i], c[j] = c[j], c[i] }
+func (c *candidates) Push(x interface{}) { *c = append(*c, x.(candidate)) }
+func (c *candidates) Pop() interface{} {
+	old := *c
+	x := old[len(old)-1]
+	*c = old[:len(old)-1]
+	return x
+}
+
+// candidates scans the tree for the n keys to evict first, ordered as a min heap by score.
+// Under EvictLFU each key's hits are halved as it is scanned so past popularity decays.
+func (bst *BST) candidates(n int) candidates {
+	defer bst.unpin(bst.pin())
+	bst.incr(MetricEvictionsScans, 1)
+
+	// Keep the n lowest scores in a max heap by negating them, the worst candidate is on top
+	var worst candidates
+	bst.walk((*Node)(atomic.LoadPointer(&bst.Root)), func(key *Key) bool {
+		score := atomic.LoadInt64(&key.accessed)
+		if bst.EvictionPolicy == EvictLFU {
+			hits := atomic.LoadUint32(&key.hits)
+			atomic.CompareAndSwapUint32(&key.hits, hits, hits/2)
+			score = int64(hits)
+		}
+
+		if len(worst) < n {
+			heap.Push(&worst, candidate{key: key, score: -score})
+		} else if -score > worst[0].score {
+			worst[0] = candidate{key: key, score: -score}
+			heap.Fix(&worst, 0)
+		}
+		return true
+	})
+
+	for i := range worst {
+		worst[i].score = -worst[i].score
+	}
+	heap.Init(&worst)
+	return worst
+}
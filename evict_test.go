@@ -0,0 +1,160 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestBST_EvictLRU(t *testing.T) {
+	var evicted []string
+	bst := New(WithMemoryLimit(0, 100, EvictLRU), WithEvictionCallback(func(key []byte, values [][]byte) {
+		evicted = append(evicted, string(key))
+	}))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	for i := 0; i < 100; i++ {
+		bst.PutOffQueue([]byte(fmt.Sprintf("key%03d", i)), []byte("value"))
+	}
+
+	// Access the first half so the second half is least recently used
+	for i := 0; i < 50; i++ {
+		bst.Get([]byte(fmt.Sprintf("key%03d", i)))
+	}
+
+	for i := 100; i < 120; i++ {
+		bst.PutOffQueue([]byte(fmt.Sprintf("key%03d", i)), []byte("value"))
+	}
+
+	stats := bst.MemoryStats()
+	if stats.Keys > 100 {
+		t.Fatalf("expected at most 100 keys, got %d", stats.Keys)
+	}
+
+	if stats.Evictions != int64(len(evicted)) || stats.Evictions == 0 {
+		t.Fatalf("expected evictions to match the callback, got %d and %d", stats.Evictions, len(evicted))
+	}
+
+	for _, key := range evicted {
+		if key < "key050" || key > "key099" {
+			t.Fatalf("expected only untouched keys to be evicted, got %s", key)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		if bst.Get([]byte(fmt.Sprintf("key%03d", i))) == nil {
+			t.Fatalf("expected key%03d to be kept", i)
+		}
+	}
+}
+
+func TestBST_EvictLFU(t *testing.T) {
+	// Each key and its value take 11 bytes
+	bst := New(WithMemoryLimit(11*10, 0, EvictLFU))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	for i := 0; i < 10; i++ {
+		bst.PutOffQueue([]byte(fmt.Sprintf("key%03d", i)), []byte("value"))
+	}
+
+	if stats := bst.MemoryStats(); stats.Bytes != 110 {
+		t.Fatalf("expected 110 bytes, got %d", stats.Bytes)
+	}
+
+	// key000 is accessed least often
+	for i := 1; i < 10; i++ {
+		for j := 0; j < 5; j++ {
+			bst.Get([]byte(fmt.Sprintf("key%03d", i)))
+		}
+	}
+
+	bst.PutOffQueue([]byte("key010"), []byte("value"))
+
+	if bst.Get([]byte("key000")) != nil {
+		t.Fatal("expected the least frequently used key to be evicted")
+	}
+
+	stats := bst.MemoryStats()
+	if stats.Bytes > 110 || stats.EvictedBytes != 11*int64(stats.Evictions) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestBST_MemoryAccounting(t *testing.T) {
+	registry := NewRegistry()
+	bst := New(WithMetrics(registry))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.PutOffQueue([]byte("key"), []byte("value"))
+	bst.PutOffQueue([]byte("key"), []byte("value 2"))
+	bst.Set([]byte("key2"), []byte("value"))
+	bst.CompareAndSwap([]byte("key2"), [][]byte{[]byte("value")}, [][]byte{[]byte("a"), []byte("b")})
+
+	if stats := bst.MemoryStats(); stats.Bytes != 3+5+7+4+2 {
+		t.Fatalf("expected 21 bytes, got %d", stats.Bytes)
+	}
+
+	bst.removeOffQueue([]byte("key"), []byte("value"))
+	bst.deleteKey([]byte("key2"), nil)
+
+	if stats := bst.MemoryStats(); stats.Bytes != 3+7 || stats.Keys != 1 {
+		t.Fatalf("expected 10 bytes within 1 key, got %+v", stats)
+	}
+
+	if registry.Gauge(MetricBytes) != 10 {
+		t.Fatalf("expected bytes gauge of 10, got %d", registry.Gauge(MetricBytes))
+	}
+}
+
+func TestBST_EvictConcurrentGet(t *testing.T) {
+	bst := New(WithMemoryLimit(0, 50, EvictLRU))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				bst.Get([]byte(fmt.Sprintf("key%03d", j%200)))
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		bst.PutOffQueue([]byte(fmt.Sprintf("key%03d", i)), []byte("value"))
+	}
+	wg.Wait()
+
+	if keys := bst.MemoryStats().Keys; keys > 50 {
+		t.Fatalf("expected at most 50 keys, got %d", keys)
+	}
+}
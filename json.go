@@ -0,0 +1,278 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Encoding converts binary keys and values to and from strings for JSON export
+type Encoding interface {
+	EncodeToString(src []byte) string
+	DecodeString(s string) ([]byte, error)
+}
+
+var (
+	Base64Encoding Encoding = base64.StdEncoding // Base64Encoding is the default encoding
+	HexEncoding    Encoding = hexEncoding{}      // HexEncoding encodes bytes as lowercase hex
+	StringEncoding Encoding = stringEncoding{}   // StringEncoding writes bytes as is, for UTF-8 keys and values
+)
+
+// hexEncoding is an Encoding using encoding/hex
+type hexEncoding struct{}
+
+func (hexEncoding) EncodeToString(src []byte) string      { return hex.EncodeToString(src) }
+func (hexEncoding) DecodeString(s string) ([]byte, error) { return hex.DecodeString(s) }
+
+// stringEncoding is an Encoding that converts bytes directly to strings
+type stringEncoding struct{}
+
+func (stringEncoding) EncodeToString(src []byte) string      { return string(src) }
+func (stringEncoding) DecodeString(s string) ([]byte, error) { return []byte(s), nil }
+
+// WithEncoding sets the encoding used for keys and values in JSON and NDJSON export and import
+func WithEncoding(enc Encoding) Option {
+	return func(bst *BST) {
+		bst.Encoding = enc
+	}
+}
+
+// record is a key and its values as exported to JSON
+type record struct {
+	Key     string   `json:"key"`
+	Values  []string `json:"values"`
+	Expires []int64  `json:"expires,omitempty"` // Expiry of each value in unix nanoseconds, 0 for none, omitted if none expire
+}
+
+// encoding returns the tree's encoding, Base64Encoding if none is set
+func (bst *BST) encoding() Encoding {
+	if bst.Encoding == nil {
+		return Base64Encoding
+	}
+	return bst.Encoding
+}
+
+// record encodes a key with the values of state s as a JSON record
+func (bst *BST) record(key *Key, s *keyState) record {
+	enc := bst.encoding()
+
+	r := record{Key: enc.EncodeToString(key.bytes()), Values: make([]string, s.len())}
+	for i, v := range bst.decodeValues(s.list()) {
+		r.Values[i] = enc.EncodeToString(v)
+	}
+
+	for i := 0; i < s.len(); i++ {
+		if s.expiry(i) != 0 {
+			r.Expires = append([]int64(nil), s.expires...)
+			break
+		}
+	}
+	return r
+}
+
+// decodeRecord decodes a JSON record's key, values and their expiries
+func (bst *BST) decodeRecord(r record) (entry, error) {
+	enc := bst.encoding()
+
+	key, err := enc.DecodeString(r.Key)
+	if err != nil {
+		return entry{}, err
+	}
+
+	if r.Expires != nil && len(r.Expires) != len(r.Values) {
+		return entry{}, ErrInvalidRecord
+	}
+
+	e := entry{key: key, values: make([][]byte, len(r.Values)), expires: r.Expires}
+	for i, v := range r.Values {
+		if e.values[i], err = enc.DecodeString(v); err != nil {
+			return entry{}, err
+		}
+	}
+	return e, nil
+}
+
+// putRecord writes a decoded record to the tree, creating the key even if it has no values
+func (bst *BST) putRecord(e entry) {
+	if len(e.values) == 0 {
+		bst.upsert(e.key, func() *Key {
+			return bst.newKey(bst.keep(e.key))
+		}, func(*Key) {})
+		return
+	}
+
+	now := time.Now().UnixNano()
+	for i, value := range e.values {
+		var expires int64
+		if e.expires != nil {
+			expires = e.expires[i]
+		}
+
+		switch {
+		case expires == 0:
+			bst.PutOffQueue(e.key, value)
+		case expires > now:
+			// Keep the value's original expiry
+			atomic.StoreInt32(&bst.ttl, 1)
+			k, v := bst.ownPair(e.key, value)
+			bst.putOffQueue(k, v, expires)
+		}
+	}
+}
+
+// walk calls fn for every key in order until fn returns false
+func (bst *BST) walk(node *Node, fn func(*Key) bool) bool {
+	if node == nil {
+		return true
+	}
+
+	k := node.key()
+
+	if !bst.walk(node.left(), fn) {
+		return false
+	}
+
+	if !fn(k) {
+		return false
+	}
+
+	return bst.walk(node.right(), fn)
+}
+
+// MarshalJSON encodes the tree as a JSON array of key and values records in sorted order.  It is
+// never encrypted, even with WithEncryption, use ExportNDJSON to write sealed exports.
+func (bst *BST) MarshalJSON() ([]byte, error) {
+	records := make([]record, 0)
+
+	defer bst.unpin(bst.pin())
+
+	now := time.Now().UnixNano()
+	bst.walk((*Node)(atomic.LoadPointer(&bst.Root)), func(key *Key) bool {
+		if s := key.load().live(now); s != nil {
+			records = append(records, bst.record(key, s))
+		}
+		return true
+	})
+
+	return json.Marshal(records)
+}
+
+// UnmarshalJSON writes a JSON array of key and values records to the tree.  Every record is decoded
+// before any is written, so nothing is written if one is invalid.  The tree must have been created with New.
+func (bst *BST) UnmarshalJSON(data []byte) error {
+	var records []record
+	if err := json.Unmarshal(data, &records); err != nil {
+		return err
+	}
+
+	// Insert medians first so sorted input does not build a degenerate tree
+	return bst.putBalanced(records)
+}
+
+// putBalanced decodes every record, then writes the median record and recurses into each half
+func (bst *BST) putBalanced(records []record) error {
+	entries := make([]entry, len(records))
+	for i, r := range records {
+		var err error
+		if entries[i], err = bst.decodeRecord(r); err != nil {
+			return err
+		}
+	}
+
+	bst.putEntries(entries)
+	return nil
+}
+
+// putEntries writes the median decoded record then recurses into each half
+func (bst *BST) putEntries(entries []entry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	mid := len(entries) / 2
+	bst.putRecord(entries[mid])
+	bst.putEntries(entries[:mid])
+	bst.putEntries(entries[mid+1:])
+}
+
+// ExportNDJSON writes one JSON key and values record per line in sorted order.  With encryption each
+// record is sealed with the provider's current key and a sealed trailer ends the export.
+func (bst *BST) ExportNDJSON(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+
+	var s *sealer
+	var err error
+	if bst.Encryption != nil {
+		if s, err = bst.newSealer(); err != nil {
+			return err
+		}
+	}
+
+	defer bst.unpin(bst.pin())
+
+	now := time.Now().UnixNano()
+	bst.walk((*Node)(atomic.LoadPointer(&bst.Root)), func(key *Key) bool {
+		if live := key.load().live(now); live != nil {
+			err = writeRecord(encoder, s, bst.record(key, live))
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if s != nil {
+		if err := writeTrailer(encoder, s); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// ImportNDJSON reads JSON key and values records, one per line, and writes them to the tree.  Without
+// encryption each record is written as it is read, so records before an invalid line are kept.  With
+// encryption the input must be a sealed export, nothing is written and ErrTampered is returned if any
+// line fails authentication or the export was truncated.
+func (bst *BST) ImportNDJSON(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	if bst.Encryption != nil {
+		return bst.importSealed(decoder)
+	}
+
+	for {
+		var rec record
+		if err := decoder.Decode(&rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		e, err := bst.decodeRecord(rec)
+		if err != nil {
+			return err
+		}
+		bst.putRecord(e)
+	}
+}
@@ -0,0 +1,234 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBST_MarshalJSON(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.Put([]byte("key2"), []byte("value 2"))
+	bst.Put([]byte("key1"), []byte("value 1"))
+	bst.Put([]byte("key1"), []byte{0xff})
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	data, err := json.Marshal(bst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `[{"key":"a2V5MQ==","values":["dmFsdWUgMQ==","/w=="]},{"key":"a2V5Mg==","values":["dmFsdWUgMg=="]}]`
+	if string(data) != expect {
+		t.Fatalf("expected %s, got %s", expect, data)
+	}
+
+	other := New()
+	defer other.Close()
+
+	if err := json.Unmarshal(data, other); err != nil {
+		t.Fatal(err)
+	}
+
+	key := other.Get([]byte("key1"))
+	if key == nil {
+		t.Fatal("key is nil")
+	}
+
+	if len(key.Values) != 2 || string(key.Values[0]) != "value 1" || !bytes.Equal(key.Values[1], []byte{0xff}) {
+		t.Fatalf("unexpected values %q", key.Values)
+	}
+}
+
+func TestBST_ExportNDJSON(t *testing.T) {
+	bst := New(WithEncoding(StringEncoding))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.Put([]byte("b"), []byte("2"))
+	bst.Put([]byte("a"), []byte("1"))
+	bst.Put([]byte("c"), []byte("3"))
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := bst.ExportNDJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `{"key":"a","values":["1"]}
+{"key":"b","values":["2"]}
+{"key":"c","values":["3"]}
+`
+	if buf.String() != expect {
+		t.Fatalf("expected\n%s\ngot\n%s", expect, buf.String())
+	}
+}
+
+func TestBST_ImportNDJSON(t *testing.T) {
+	bst := New(WithEncoding(HexEncoding))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	input := `{"key":"6b31","values":["7631","7632"]}
+{"key":"6b32","values":["7633"]}
+`
+	if err := bst.ImportNDJSON(strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := bst.Range([]byte("k1"), []byte("k2"))
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(keys))
+	}
+
+	if string(keys[0].Values[1]) != "v2" || string(keys[1].Values[0]) != "v3" {
+		t.Fatal("unexpected values")
+	}
+
+	if err := bst.ImportNDJSON(strings.NewReader(`{"key":"zz","values":[]}`)); err == nil {
+		t.Fatal("expected error for invalid hex")
+	}
+}
+
+func TestBST_JSONExpiry(t *testing.T) {
+	bst := New(WithEncoding(StringEncoding), WithReapInterval(0))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.Put([]byte("a"), []byte("1"))
+	bst.PutWithTTL([]byte("b"), []byte("2"), 50*time.Millisecond)
+	bst.Put([]byte("b"), []byte("3"))
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := bst.ExportNDJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(buf.String(), "\n")
+	if lines[0] != `{"key":"a","values":["1"]}` || !strings.Contains(lines[1], `"expires":[`) || !strings.HasSuffix(lines[1], `,0]}`) {
+		t.Fatalf("expected only b to export its expiries, got\n%s", buf.String())
+	}
+
+	other := New(WithEncoding(StringEncoding), WithReapInterval(0))
+	defer other.Close()
+
+	if err := other.ImportNDJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	key := other.Get([]byte("b"))
+	if key == nil || len(key.Values) != 2 || key.Expires[0] != bst.Get([]byte("b")).Expires[0] {
+		t.Fatal("expected the expiry to be restored")
+	}
+
+	// wait for the value to expire
+	time.Sleep(50 * time.Millisecond)
+
+	key = other.Get([]byte("b"))
+	if key == nil || len(key.Values) != 1 || string(key.Values[0]) != "3" {
+		t.Fatal("expected the imported value to expire")
+	}
+
+	// Already expired values are not imported
+	expired := `{"key":"c","values":["4"],"expires":[1]}`
+	if err := other.ImportNDJSON(strings.NewReader(expired)); err != nil {
+		t.Fatal(err)
+	}
+
+	if other.Get([]byte("c")) != nil {
+		t.Fatal("expected the expired value to be skipped")
+	}
+
+	if err := other.ImportNDJSON(strings.NewReader(`{"key":"d","values":["5"],"expires":[]}`)); err != ErrInvalidRecord {
+		t.Fatalf("expected ErrInvalidRecord, got %v", err)
+	}
+}
+
+func TestBST_UnmarshalJSONEmptyValues(t *testing.T) {
+	bst := New(WithEncoding(StringEncoding))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	if err := json.Unmarshal([]byte(`[{"key":"a","values":[]},{"key":"b","values":["1"]}]`), bst); err != nil {
+		t.Fatal(err)
+	}
+
+	key := bst.Get([]byte("a"))
+	if key == nil || len(key.Values) != 0 {
+		t.Fatal("expected a key without values")
+	}
+
+	data, err := json.Marshal(bst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `[{"key":"a","values":[]},{"key":"b","values":["1"]}]`
+	if string(data) != expect {
+		t.Fatalf("expected %s, got %s", expect, data)
+	}
+
+	if err := bst.ImportNDJSON(strings.NewReader(`{"key":"c","values":[]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if bst.Get([]byte("c")) == nil {
+		t.Fatal("expected an imported key without values")
+	}
+}
+
+func TestBST_UnmarshalJSONInvalid(t *testing.T) {
+	bst := New(WithEncoding(HexEncoding))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	// The invalid record is not the median, which is written first
+	data := `[{"key":"6b31","values":["7631"]},{"key":"6b32","values":["7632"]},{"key":"6b33","values":["zz"]}]`
+	if err := json.Unmarshal([]byte(data), bst); err == nil {
+		t.Fatal("expected error for invalid hex")
+	}
+
+	if keys := bst.Range([]byte("k1"), []byte("k3")); len(keys) != 0 {
+		t.Fatalf("expected nothing to be written, got %d keys", len(keys))
+	}
+}
@@ -0,0 +1,142 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"time"
+)
+
+// MergeOperator combines the current values of a key with an operand, returning the new values.
+// existing is empty if the key does not exist.  It is called with the key latch held and
+// must not retain or modify existing.
+type MergeOperator func(existing [][]byte, operand []byte) [][]byte
+
+// WithMergeOperator sets the operator used by Merge
+func WithMergeOperator(op MergeOperator) Option {
+	return func(bst *BST) {
+		bst.MergeOperator = op
+	}
+}
+
+// Merge queues operand to be combined with the key's values by the tree's merge operator.
+// Merges are applied by the background writer in order with puts.  Returns ErrQueueFull if
+// the write queue is full and the tree's QueuePolicy is QueueFail.
+func (bst *BST) Merge(key, operand []byte) error {
+	if bst.MergeOperator == nil {
+		return ErrNoMergeOperator
+	}
+
+	return bst.enqueue(context.Background(), bst.putOperation(OpMerge, key, operand, 0))
+}
+
+// mergeOffQueue applies the merge operator to a key, creating it if it does not exist
+func (bst *BST) mergeOffQueue(key, operand []byte) {
+	defer bst.notify(Event{Type: EventMerge, Key: key, Value: operand})
+	defer bst.observe(MetricPutDuration, time.Now())
+	bst.incr(MetricPuts, 1)
+
+	bst.upsert(key, func() *Key {
+		k := bst.newKey(key)
+		k.setValues(bst.merge(nil, operand), nil)
+		return k
+	}, func(existing *Key) {
+		bst.mergeInto(existing, operand)
+	})
+}
+
+// mergeInto applies the merge operator to a key's live values, keeping the expiry of each value the
+// key already held.  The key latch must be held.
+func (bst *BST) mergeInto(k *Key, operand []byte) {
+	now := time.Now().UnixNano()
+
+	var live [][]byte
+	var expires []int64
+	if s := k.load().live(now); s != nil {
+		live, expires = s.list(), s.expires
+	}
+
+	values := bst.merge(live, operand)
+
+	// Values are stored deterministically, so a retained value is found by its stored form
+	var kept []int64
+	if expires != nil {
+		kept = make([]int64, len(values))
+		for i, v := range values {
+			if j := indexOfValue(live, v); j >= 0 {
+				kept[i] = expires[j]
+			}
+		}
+	}
+	k.setValues(values, kept)
+}
+
+// merge applies the merge operator to existing values as stored, returning the values to store as the
+// value mode holds them
+func (bst *BST) merge(existing [][]byte, operand []byte) [][]byte {
+	return bst.encodeValues(normalize(bst.MergeOperator(bst.decodeValues(existing), operand), bst.ValueMode))
+}
+
+// MergeInt64Add treats the key's single value and the operand as big endian int64s and stores their sum
+func MergeInt64Add(existing [][]byte, operand []byte) [][]byte {
+	return [][]byte{encodeInt64(decodeInt64(existing) + decodeInt64([][]byte{operand}))}
+}
+
+// MergeInt64Max treats the key's single value and the operand as big endian int64s and stores the larger
+func MergeInt64Max(existing [][]byte, operand []byte) [][]byte {
+	n := decodeInt64([][]byte{operand})
+	if len(existing) > 0 && decodeInt64(existing) > n {
+		n = decodeInt64(existing)
+	}
+	return [][]byte{encodeInt64(n)}
+}
+
+// MergeAppend appends the operand to the key's single value
+func MergeAppend(existing [][]byte, operand []byte) [][]byte {
+	var value []byte
+	if len(existing) > 0 {
+		value = append(value, existing[0]...)
+	}
+	return [][]byte{append(value, operand...)}
+}
+
+// MergeSetUnion adds the operand to the key's values if it is not already present
+func MergeSetUnion(existing [][]byte, operand []byte) [][]byte {
+	for _, v := range existing {
+		if bytes.Equal(v, operand) {
+			return copyValues(existing)
+		}
+	}
+	return append(copyValues(existing), operand)
+}
+
+// decodeInt64 decodes the first value as a big endian int64, 0 if there is none or it is too short
+func decodeInt64(values [][]byte) int64 {
+	if len(values) == 0 || len(values[0]) < 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(values[0]))
+}
+
+// encodeInt64 encodes n as a big endian int64
+func encodeInt64(n int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(n))
+	return b
+}
@@ -0,0 +1,147 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBST_Merge(t *testing.T) {
+	bst := New(WithMergeOperator(MergeInt64Add))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := bst.Merge([]byte("counter"), encodeInt64(1)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	key := bst.Get([]byte("counter"))
+	if key == nil || decodeInt64(key.Values) != 1000 {
+		t.Fatal("expected counter to be 1000")
+	}
+}
+
+func TestBST_MergeNoOperator(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	if err := bst.Merge([]byte("key"), []byte("value")); err != ErrNoMergeOperator {
+		t.Fatalf("expected ErrNoMergeOperator, got %v", err)
+	}
+}
+
+func TestMergeOperators(t *testing.T) {
+	values := MergeInt64Max([][]byte{encodeInt64(5)}, encodeInt64(3))
+	if decodeInt64(values) != 5 {
+		t.Fatal("expected max to keep 5")
+	}
+
+	values = MergeInt64Max(nil, encodeInt64(-3))
+	if decodeInt64(values) != -3 {
+		t.Fatal("expected max of nothing to be the operand")
+	}
+
+	values = MergeAppend(MergeAppend(nil, []byte("a")), []byte("b"))
+	if len(values) != 1 || string(values[0]) != "ab" {
+		t.Fatal("expected ab")
+	}
+
+	values = MergeSetUnion(MergeSetUnion([][]byte{[]byte("a")}, []byte("b")), []byte("a"))
+	if len(values) != 2 || string(values[1]) != "b" {
+		t.Fatal("expected a and b")
+	}
+}
+
+func TestBST_MergeValueMode(t *testing.T) {
+	bst := New(WithMergeOperator(MergeSetUnion), WithValueMode(ValueSortedSet))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.Put([]byte("key"), []byte("m"))
+	bst.Put([]byte("key"), []byte("z"))
+	bst.Merge([]byte("key"), []byte("a"))
+
+	// The merged value is kept in order, so it is found by the sorted set's binary search
+	if !bst.Remove([]byte("key"), []byte("a")) {
+		t.Fatal("expected the merged value to be removed")
+	}
+
+	m := New(WithMergeOperator(MergeSetUnion), WithValueMode(ValueMap))
+	defer m.Close()
+
+	m.Put([]byte("key"), []byte("a"))
+	m.Merge([]byte("key"), []byte("b"))
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	key := m.Get([]byte("key"))
+	if key == nil || len(key.Values) != 1 || string(key.Values[0]) != "b" {
+		t.Fatalf("expected the map to hold only the merged value")
+	}
+}
+
+func TestBST_MergeExpiry(t *testing.T) {
+	bst := New(WithMergeOperator(MergeSetUnion), WithReapInterval(0))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.PutWithTTL([]byte("key"), []byte("a"), 20*time.Millisecond)
+	bst.Merge([]byte("key"), []byte("b"))
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	key := bst.Get([]byte("key"))
+	if key == nil || len(key.Values) != 2 || key.Expires[0] == 0 || key.Expires[1] != 0 {
+		t.Fatalf("expected a to keep its expiry and b to have none")
+	}
+
+	// wait for the value to expire
+	time.Sleep(20 * time.Millisecond)
+
+	key = bst.Get([]byte("key"))
+	if key == nil || len(key.Values) != 1 || string(key.Values[0]) != "b" {
+		t.Fatalf("expected a to expire after the merge")
+	}
+}
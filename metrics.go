@@ -0,0 +1,275 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metric names reported by the BST
+const (
+	MetricPuts       = "bst_puts_total"        // Keys or values applied by the background writer
+	MetricGets       = "bst_gets_total"        // Get calls
+	MetricGetHits    = "bst_get_hits_total"    // Get calls that found the key
+	MetricGetMisses  = "bst_get_misses_total"  // Get calls that did not find the key
+	MetricRemoves    = "bst_removes_total"     // Remove calls
+	MetricDeletes    = "bst_deletes_total"     // Delete calls
+	MetricCASRetries = "bst_cas_retries_total" // Failed compare and swaps retried in PutOffQueue
+
+	MetricQueueDepth = "bst_write_queue_depth" // Writes waiting in the write queue
+	MetricNodes      = "bst_nodes"             // Nodes within the tree
+
+	MetricPutDuration    = "bst_put_duration_seconds"    // Time to apply a write in PutOffQueue
+	MetricGetDuration    = "bst_get_duration_seconds"    // Time to look up a key
+	MetricRemoveDuration = "bst_remove_duration_seconds" // Time to remove a value
+	MetricDeleteDuration = "bst_delete_duration_seconds" // Time to delete a key
+	MetricRangeDuration  = "bst_range_duration_seconds"  // Time for range and comparison queries
+)
+
+// Metrics receives instrumentation from a BST
+type Metrics interface {
+	Add(name string, delta int64)         // Add increments a counter
+	Set(name string, value int64)         // Set sets a gauge
+	Observe(name string, d time.Duration) // Observe records a latency in a histogram
+}
+
+// WithMetrics reports the tree's instrumentation to m
+func WithMetrics(m Metrics) Option {
+	return func(bst *BST) {
+		bst.Metrics = m
+	}
+}
+
+// incr adds delta to a counter if metrics are enabled
+func (bst *BST) incr(name string, delta int64) {
+	if bst.Metrics != nil {
+		bst.Metrics.Add(name, delta)
+	}
+}
+
+// gauge sets a gauge if metrics are enabled
+func (bst *BST) gauge(name string, value int64) {
+	if bst.Metrics != nil {
+		bst.Metrics.Set(name, value)
+	}
+}
+
+// observe records the time since start if metrics are enabled, meant to be deferred
+func (bst *BST) observe(name string, start time.Time) {
+	if bst.Metrics != nil {
+		bst.Metrics.Observe(name, time.Since(start))
+	}
+}
+
+// DefaultBuckets are the histogram upper bounds in seconds used by a Registry
+var DefaultBuckets = []float64{.000001, .000005, .00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1}
+
+// Registry is a dependency free Metrics implementation which can be published under expvar
+// or scraped in the Prometheus text exposition format
+type Registry struct {
+	lock       sync.RWMutex
+	counters   map[string]*int64
+	gauges     map[string]*int64
+	histograms map[string]*histogram
+}
+
+// histogram is a fixed bucket latency histogram
+type histogram struct {
+	counts []uint64 // Observations per bucket, the last bucket is +Inf
+	sum    int64    // Sum of all observations in nanoseconds
+	count  uint64   // Number of observations
+}
+
+// NewRegistry creates a new metrics registry
+func NewRegistry() *Registry {
+	return &Registry{
+		counters:   make(map[string]*int64),
+		gauges:     make(map[string]*int64),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+// Add increments a counter
+func (r *Registry) Add(name string, delta int64) {
+	atomic.AddInt64(r.value(r.counters, name), delta)
+}
+
+// Set sets a gauge
+func (r *Registry) Set(name string, value int64) {
+	atomic.StoreInt64(r.value(r.gauges, name), value)
+}
+
+// Observe records a latency in a histogram
+func (r *Registry) Observe(name string, d time.Duration) {
+	r.lock.RLock()
+	h, ok := r.histograms[name]
+	r.lock.RUnlock()
+
+	if !ok {
+		r.lock.Lock()
+		if h, ok = r.histograms[name]; !ok {
+			h = &histogram{counts: make([]uint64, len(DefaultBuckets)+1)}
+			r.histograms[name] = h
+		}
+		r.lock.Unlock()
+	}
+
+	i := sort.SearchFloat64s(DefaultBuckets, d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+	atomic.AddUint64(&h.count, 1)
+}
+
+// Counter returns the current value of a counter
+func (r *Registry) Counter(name string) int64 {
+	return r.load(r.counters, name)
+}
+
+// Gauge returns the current value of a gauge
+func (r *Registry) Gauge(name string) int64 {
+	return r.load(r.gauges, name)
+}
+
+// value returns the value for name within m, creating it if it does not exist
+func (r *Registry) value(m map[string]*int64, name string) *int64 {
+	r.lock.RLock()
+	v, ok := m[name]
+	r.lock.RUnlock()
+	if ok {
+		return v
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if v, ok = m[name]; !ok {
+		v = new(int64)
+		m[name] = v
+	}
+	return v
+}
+
+// load reads the value for name within m, 0 if it does not exist
+func (r *Registry) load(m map[string]*int64, name string) int64 {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if v, ok := m[name]; ok {
+		return atomic.LoadInt64(v)
+	}
+	return 0
+}
+
+// Snapshot returns the current counters, gauges and histogram counts and sums
+func (r *Registry) Snapshot() map[string]interface{} {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	snap := make(map[string]interface{})
+	for name, v := range r.counters {
+		snap[name] = atomic.LoadInt64(v)
+	}
+	for name, v := range r.gauges {
+		snap[name] = atomic.LoadInt64(v)
+	}
+	for name, h := range r.histograms {
+		snap[name+"_count"] = atomic.LoadUint64(&h.count)
+		snap[name+"_sum"] = time.Duration(atomic.LoadInt64(&h.sum)).Seconds()
+	}
+	return snap
+}
+
+// Publish registers the registry under expvar with the given name.
+// Like expvar.Publish it panics if the name is already registered.
+func (r *Registry) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return r.Snapshot()
+	}))
+}
+
+// WriteText writes the registry in the Prometheus text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, name := range sortedNames(r.counters) {
+		if _, err := fmt.Fprintf(w, "# TYPE %s counter\n%s %d\n", name, name, atomic.LoadInt64(r.counters[name])); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range sortedNames(r.gauges) {
+		if _, err := fmt.Fprintf(w, "# TYPE %s gauge\n%s %d\n", name, name, atomic.LoadInt64(r.gauges[name])); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(r.histograms))
+	for name := range r.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		h := r.histograms[name]
+		if _, err := fmt.Fprintf(w, "# TYPE %s histogram\n", name); err != nil {
+			return err
+		}
+
+		// Prometheus buckets are cumulative
+		var cumulative uint64
+		for i := range h.counts {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			le := "+Inf"
+			if i < len(DefaultBuckets) {
+				le = strconv.FormatFloat(DefaultBuckets[i], 'g', -1, 64)
+			}
+			if _, err := fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, le, cumulative); err != nil {
+				return err
+			}
+		}
+
+		sum := time.Duration(atomic.LoadInt64(&h.sum)).Seconds()
+		if _, err := fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, sum, name, atomic.LoadUint64(&h.count)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ServeHTTP serves the registry in the Prometheus text exposition format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = r.WriteText(w)
+}
+
+// sortedNames returns the names within m in sorted order
+func sortedNames(m map[string]*int64) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
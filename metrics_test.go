@@ -0,0 +1,114 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBST_Metrics(t *testing.T) {
+	registry := NewRegistry()
+	bst := New(WithMetrics(registry))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.Put([]byte("key"), []byte("value"))
+	bst.Put([]byte("key"), []byte("value 2"))
+	bst.Put([]byte("key2"), []byte("value"))
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	bst.Get([]byte("key"))
+	bst.Get([]byte("key3"))
+	bst.Remove([]byte("key"), []byte("value 2"))
+	bst.Delete([]byte("key2"))
+
+	expect := map[string]int64{
+		MetricPuts:      3,
+		MetricGets:      2,
+		MetricGetHits:   1,
+		MetricGetMisses: 1,
+		MetricRemoves:   1,
+		MetricDeletes:   1,
+	}
+
+	for name, v := range expect {
+		if registry.Counter(name) != v {
+			t.Fatalf("expected %s to be %d, got %d", name, v, registry.Counter(name))
+		}
+	}
+
+	if registry.Gauge(MetricNodes) != 1 {
+		t.Fatalf("expected 1 node, got %d", registry.Gauge(MetricNodes))
+	}
+
+	if registry.Gauge(MetricQueueDepth) != 0 {
+		t.Fatalf("expected empty write queue, got %d", registry.Gauge(MetricQueueDepth))
+	}
+}
+
+func TestRegistry_WriteText(t *testing.T) {
+	registry := NewRegistry()
+	registry.Add(MetricPuts, 2)
+	registry.Set(MetricNodes, 5)
+	registry.Observe(MetricGetDuration, 2*time.Microsecond)
+
+	var buf bytes.Buffer
+	if err := registry.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE bst_puts_total counter\nbst_puts_total 2\n",
+		"# TYPE bst_nodes gauge\nbst_nodes 5\n",
+		"bst_get_duration_seconds_bucket{le=\"1e-06\"} 0\n",
+		"bst_get_duration_seconds_bucket{le=\"5e-06\"} 1\n",
+		"bst_get_duration_seconds_bucket{le=\"+Inf\"} 1\n",
+		"bst_get_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Fatalf("expected output to contain %q, got\n%s", line, out)
+		}
+	}
+}
+
+func TestRegistry_Publish(t *testing.T) {
+	registry := NewRegistry()
+	registry.Add(MetricGets, 3)
+
+	// expvar names can only be published once per process, so each run of the test uses its own
+	name := fmt.Sprintf("bst_test_registry_%d", time.Now().UnixNano())
+	registry.Publish(name)
+
+	v := expvar.Get(name)
+	if v == nil {
+		t.Fatal("expected registry to be published")
+	}
+
+	if !strings.Contains(v.String(), `"bst_gets_total":3`) {
+		t.Fatalf("expected gets counter in %s", v.String())
+	}
+}
@@ -0,0 +1,397 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PartitionedBST holds ordered partitions of keys, each backed by its own tree.  A partition which
+// grows past MaxPartitionKeys is split at its median key and neighbours which together shrink below
+// MinPartitionKeys are merged.  Writes are applied immediately rather than queued so a partition is
+// never replaced while writes to it are pending.
+type PartitionedBST struct {
+	MaxPartitionKeys int64        // Keys in a partition before it is split, 0 to never split
+	MinPartitionKeys int64        // Keys in two neighbouring partitions below which they are merged, 0 to never merge
+	options          []Option     // Options configuring each partition's tree
+	lock             sync.RWMutex // Held for reading by reads and writes, for writing while splitting or merging
+	partitions       []*partition // Partitions in key order
+	splits           int64        // Partitions split
+	merges           int64        // Partitions merged
+}
+
+// partition is a tree holding the keys from start up to the start of the next partition
+type partition struct {
+	start []byte // Lowest key of the partition, nil for the first
+	bst   *BST   // Tree holding the keys
+}
+
+// entry is a key and its values, as stored when moved between partitions or as decoded from a JSON record
+type entry struct {
+	key     []byte   // Key
+	values  [][]byte // Values
+	expires []int64  // Expiry of each value, nil if none expire
+}
+
+// PartitionStats are the partitions of a PartitionedBST and how they changed
+type PartitionStats struct {
+	Partitions int   // Current partitions
+	Splits     int64 // Partitions split
+	Merges     int64 // Partitions merged
+}
+
+// NewPartitioned creates a partition per range between splits, each tree configured by opts.  A partition
+// is split once it holds more than maxKeys keys, and merged with a neighbour while both hold fewer than
+// maxKeys/4 together.  A maxKeys of 0 keeps the initial partitions.  Metrics are reported as by NewSharded,
+// with the gauges of a partition removed once it is split or merged.
+func NewPartitioned(splits [][]byte, maxKeys int64, opts ...Option) *PartitionedBST {
+	sorted := make([][]byte, 0, len(splits))
+	for _, split := range splits {
+		sorted = append(sorted, append([]byte(nil), split...))
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+
+	opts = withGaugeSum(opts)
+
+	p := &PartitionedBST{MaxPartitionKeys: maxKeys, MinPartitionKeys: maxKeys / 4, options: opts}
+	p.partitions = append(p.partitions, &partition{bst: New(opts...)})
+	for i, split := range sorted {
+		if i == 0 || !bytes.Equal(split, sorted[i-1]) {
+			p.partitions = append(p.partitions, &partition{start: split, bst: New(opts...)})
+		}
+	}
+	return p
+}
+
+// Splits returns the lowest key of each partition after the first
+func (p *PartitionedBST) Splits() [][]byte {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	splits := make([][]byte, 0, len(p.partitions)-1)
+	for _, part := range p.partitions[1:] {
+		splits = append(splits, part.start)
+	}
+	return splits
+}
+
+// PartitionStats returns the current partitions and how many were split and merged
+func (p *PartitionedBST) PartitionStats() PartitionStats {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return PartitionStats{
+		Partitions: len(p.partitions),
+		Splits:     atomic.LoadInt64(&p.splits),
+		Merges:     atomic.LoadInt64(&p.merges),
+	}
+}
+
+// index returns the index of the partition holding key.  The lock must be held.
+func (p *PartitionedBST) index(key []byte) int {
+	return sort.Search(len(p.partitions)-1, func(i int) bool {
+		return bytes.Compare(p.partitions[i+1].start, key) > 0
+	})
+}
+
+// write applies fn to the partition holding key, then splits the partition if it grew past the limit
+// or merges it with a neighbour if it shrunk, as set by shrink, below the limit
+func (p *PartitionedBST) write(key []byte, shrink bool, fn func(*BST)) {
+	p.lock.RLock()
+	i := p.index(key)
+	part := p.partitions[i]
+	fn(part.bst)
+
+	split := !shrink && p.MaxPartitionKeys > 0 && part.bst.MemoryStats().Keys > p.MaxPartitionKeys
+	merge := shrink && p.MinPartitionKeys > 0 && p.neighbour(i) >= 0
+	p.lock.RUnlock()
+
+	if split {
+		p.split(part)
+	} else if merge {
+		p.merge(part)
+	}
+}
+
+// Put adds a value to a key
+func (p *PartitionedBST) Put(key, value []byte) {
+	p.write(key, false, func(bst *BST) {
+		bst.PutOffQueue(key, value)
+	})
+}
+
+// PutWithTTL adds a value to a key which expires after ttl.  A ttl of 0 or less never expires.
+func (p *PartitionedBST) PutWithTTL(key, value []byte, ttl time.Duration) {
+	p.write(key, false, func(bst *BST) {
+		var expires int64
+		if ttl > 0 {
+			atomic.StoreInt32(&bst.ttl, 1)
+			expires = time.Now().Add(ttl).UnixNano()
+		}
+
+		key, value := bst.ownPair(key, value)
+		bst.putOffQueue(key, value, expires)
+	})
+}
+
+// Set replaces the values of a key with a single value, returning the previous value
+func (p *PartitionedBST) Set(key, value []byte) (prev []byte, existed bool) {
+	p.write(key, false, func(bst *BST) {
+		prev, existed = bst.Set(key, value)
+	})
+	return prev, existed
+}
+
+// Remove removes a value from a key, returning whether it was removed
+func (p *PartitionedBST) Remove(key, value []byte) (removed bool) {
+	p.write(key, true, func(bst *BST) {
+		removed = bst.Remove(key, value)
+	})
+	return removed
+}
+
+// Delete removes a key, returning whether it was removed
+func (p *PartitionedBST) Delete(key []byte) (deleted bool) {
+	p.write(key, true, func(bst *BST) {
+		deleted = bst.Delete(key)
+	})
+	return deleted
+}
+
+// Get retrieves a key
+func (p *PartitionedBST) Get(key []byte) *Key {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.partitions[p.index(key)].bst.Get(key)
+}
+
+// Range calls fn with each key within a range in order until fn returns false
+func (p *PartitionedBST) Range(start, end []byte, fn func(*Key) bool) {
+	p.RangeContext(context.Background(), start, end, fn)
+}
+
+// RangeContext calls fn with each key within a range in order until fn returns false, returning ctx's
+// error if it is done first.  Keys are streamed from each partition's tree as it is traversed, from the
+// partitions as they were when the range started, so fn may write to the tree.
+func (p *PartitionedBST) RangeContext(ctx context.Context, start, end []byte, fn func(*Key) bool) error {
+	if bytes.Compare(start, end) > 0 {
+		return ctx.Err()
+	}
+
+	p.lock.RLock()
+	parts := append([]*partition(nil), p.partitions[p.index(start):p.index(end)+1]...)
+	p.lock.RUnlock()
+
+	for _, part := range parts {
+		if !part.bst.scan(start, end, fn, ctx.Done()) {
+			break
+		}
+	}
+	return ctx.Err()
+}
+
+// Close closes every partition
+func (p *PartitionedBST) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, part := range p.partitions {
+		part.bst.Close()
+	}
+}
+
+// split replaces a partition over the limit with two holding each half of its keys
+func (p *PartitionedBST) split(part *partition) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	i := p.position(part)
+	if i < 0 || part.bst.MemoryStats().Keys <= p.MaxPartitionKeys {
+		// Already split or merged by another writer
+		return
+	}
+
+	entries := part.bst.entries()
+	if len(entries) < 2 {
+		return
+	}
+
+	mid := len(entries) / 2
+	lower := &partition{start: part.start, bst: p.build(entries[:mid])}
+	upper := &partition{start: entries[mid].key, bst: p.build(entries[mid:])}
+
+	p.partitions = append(p.partitions[:i], append([]*partition{lower, upper}, p.partitions[i+1:]...)...)
+	part.bst.Close()
+	releaseGauges(part.bst)
+	atomic.AddInt64(&p.splits, 1)
+}
+
+// neighbour returns the index of the smaller neighbour of partition i if together they hold fewer
+// than MinPartitionKeys keys, -1 otherwise.  The lock must be held.
+func (p *PartitionedBST) neighbour(i int) int {
+	j := -1
+	for _, n := range []int{i - 1, i + 1} {
+		if n >= 0 && n < len(p.partitions) && (j < 0 || p.partitions[n].bst.MemoryStats().Keys < p.partitions[j].bst.MemoryStats().Keys) {
+			j = n
+		}
+	}
+
+	if j < 0 || p.partitions[i].bst.MemoryStats().Keys+p.partitions[j].bst.MemoryStats().Keys >= p.MinPartitionKeys {
+		return -1
+	}
+	return j
+}
+
+// merge replaces a partition and its smaller neighbour with one holding the keys of both, if together
+// they are still under the limit
+func (p *PartitionedBST) merge(part *partition) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	i := p.position(part)
+	if i < 0 {
+		// Already split or merged by another writer
+		return
+	}
+
+	j := p.neighbour(i)
+	if j < 0 {
+		return
+	}
+	if j < i {
+		i, j = j, i
+	}
+
+	left, right := p.partitions[i], p.partitions[j]
+
+	merged := &partition{start: left.start, bst: p.build(append(left.bst.entries(), right.bst.entries()...))}
+
+	p.partitions = append(p.partitions[:i], append([]*partition{merged}, p.partitions[j+1:]...)...)
+	left.bst.Close()
+	right.bst.Close()
+	releaseGauges(left.bst)
+	releaseGauges(right.bst)
+	atomic.AddInt64(&p.merges, 1)
+}
+
+// position returns the index of a partition, -1 if it has been replaced.  The lock must be held.
+func (p *PartitionedBST) position(part *partition) int {
+	for i, other := range p.partitions {
+		if other == part {
+			return i
+		}
+	}
+	return -1
+}
+
+// build creates a partition's tree holding entries, which are in key order
+func (p *PartitionedBST) build(entries []entry) *BST {
+	bst := New(p.options...)
+	bst.adoptBalanced(entries)
+	return bst
+}
+
+// entries returns the live keys of the tree in order with their values as stored, including keys without values
+func (bst *BST) entries() []entry {
+	var entries []entry
+
+	defer bst.unpin(bst.pin())
+
+	now := time.Now().UnixNano()
+	bst.walk((*Node)(atomic.LoadPointer(&bst.Root)), func(key *Key) bool {
+		key.Latch.Lock()
+		defer key.Latch.Unlock()
+
+		// Keys whose values have all been removed are kept, as in the tree they came from
+		if s := key.load().live(now); s != nil && !key.deleted {
+			entries = append(entries, entry{key: key.bytes(), values: s.list(), expires: s.expires})
+		}
+		return true
+	})
+	return entries
+}
+
+// adoptBalanced writes the median entry then recurses into each half, so ordered entries build a balanced tree
+func (bst *BST) adoptBalanced(entries []entry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	mid := len(entries) / 2
+	bst.adopt(entries[mid])
+	bst.adoptBalanced(entries[:mid])
+	bst.adoptBalanced(entries[mid+1:])
+}
+
+// adopt inserts a key with values as stored by a tree with the same options
+func (bst *BST) adopt(e entry) {
+	if e.expires != nil {
+		atomic.StoreInt32(&bst.ttl, 1)
+	}
+
+	bst.upsert(e.key, func() *Key {
+		k := bst.newKey(e.key)
+		k.setValues(e.values, e.expires)
+		return k
+	}, func(*Key) {})
+}
+
+// scan calls fn with each key within a range in order, returning false if fn stopped the scan or done was closed
+func (bst *BST) scan(start, end []byte, fn func(*Key) bool, done <-chan struct{}) bool {
+	defer bst.unpin(bst.pin())
+
+	now := time.Now().UnixNano()
+	return bst.scanNode((*Node)(atomic.LoadPointer(&bst.Root)), start, end, now, fn, done)
+}
+
+// scanNode calls fn with each key under node within a range in order
+func (bst *BST) scanNode(node *Node, start, end []byte, now int64, fn func(*Key) bool, done <-chan struct{}) bool {
+	if node == nil {
+		return true
+	}
+
+	k := node.key()
+	if cancelled(done) {
+		return false
+	}
+
+	if k.compare(start) > 0 && !bst.scanNode(node.left(), start, end, now, fn, done) {
+		return false
+	}
+
+	if k.compare(start) >= 0 && k.compare(end) <= 0 {
+		if key := bst.view(k, now); key != nil {
+			bst.accessed(k)
+			if !fn(key) {
+				return false
+			}
+		}
+	}
+
+	if k.compare(end) < 0 {
+		return bst.scanNode(node.right(), start, end, now, fn, done)
+	}
+	return true
+}
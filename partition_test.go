@@ -0,0 +1,266 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collect returns the keys of a range streamed from p
+func collect(p *PartitionedBST, start, end []byte) []string {
+	var keys []string
+	p.Range(start, end, func(key *Key) bool {
+		keys = append(keys, string(key.K))
+		return true
+	})
+	return keys
+}
+
+func TestPartitionedBST_Splits(t *testing.T) {
+	p := NewPartitioned([][]byte{[]byte("key50"), []byte("key20")}, 0)
+
+	defer func() {
+		p.Close()
+	}()
+
+	for i := 99; i >= 0; i-- {
+		p.Put([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+
+	if stats := p.PartitionStats(); stats.Partitions != 3 || stats.Splits != 0 {
+		t.Fatalf("expected the 3 initial partitions, got %+v", stats)
+	}
+
+	splits := p.Splits()
+	if len(splits) != 2 || string(splits[0]) != "key20" || string(splits[1]) != "key50" {
+		t.Fatalf("expected sorted splits, got %q", splits)
+	}
+
+	// Keys are held by the partition of their range
+	if n := p.partitions[0].bst.MemoryStats().Keys; n != 20 {
+		t.Fatalf("expected 20 keys in the first partition, got %d", n)
+	}
+
+	key := p.Get([]byte("key20"))
+	if key == nil || !bytes.Equal(key.Values[0], []byte("value20")) {
+		t.Fatalf("expected key20")
+	}
+
+	keys := collect(p, []byte("key18"), []byte("key52"))
+	if len(keys) != 35 || keys[0] != "key18" || keys[34] != "key52" {
+		t.Fatalf("expected keys key18 to key52, got %v", keys)
+	}
+	for i := 1; i < len(keys); i++ {
+		if keys[i-1] >= keys[i] {
+			t.Fatalf("expected keys in order, got %s before %s", keys[i-1], keys[i])
+		}
+	}
+}
+
+func TestPartitionedBST_RangeStops(t *testing.T) {
+	p := NewPartitioned([][]byte{[]byte("b"), []byte("c")}, 0)
+
+	defer func() {
+		p.Close()
+	}()
+
+	for _, k := range []string{"a1", "a2", "b1", "b2", "c1"} {
+		p.Put([]byte(k), []byte(k))
+	}
+
+	var keys []string
+	p.Range([]byte("a"), []byte("z"), func(key *Key) bool {
+		keys = append(keys, string(key.K))
+		return len(keys) < 3
+	})
+	if len(keys) != 3 || keys[2] != "b1" {
+		t.Fatalf("expected the range to stop after 3 keys, got %v", keys)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.RangeContext(ctx, []byte("a"), []byte("z"), func(*Key) bool { return true }); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestPartitionedBST_AutoSplitMerge(t *testing.T) {
+	p := NewPartitioned(nil, 32)
+
+	defer func() {
+		p.Close()
+	}()
+
+	for i := 0; i < 200; i++ {
+		p.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	p.PutWithTTL([]byte("key100"), []byte("expiring"), time.Millisecond)
+
+	stats := p.PartitionStats()
+	if stats.Partitions < 200/32 || stats.Splits == 0 {
+		t.Fatalf("expected partitions to split, got %+v", stats)
+	}
+
+	for _, part := range p.partitions {
+		if n := part.bst.MemoryStats().Keys; n > 32 {
+			t.Fatalf("expected at most 32 keys per partition, got %d", n)
+		}
+	}
+
+	if keys := collect(p, []byte("key000"), []byte("key999")); len(keys) != 200 {
+		t.Fatalf("expected 200 keys after splitting, got %d", len(keys))
+	}
+
+	// Values keep their expiry when moved between partitions
+	time.Sleep(5 * time.Millisecond)
+	key := p.Get([]byte("key100"))
+	if key == nil || len(key.Values) != 1 || !bytes.Equal(key.Values[0], []byte("value100")) {
+		t.Fatalf("expected the expired value to be gone")
+	}
+
+	for i := 0; i < 195; i++ {
+		p.Delete([]byte(fmt.Sprintf("key%03d", i)))
+	}
+
+	stats = p.PartitionStats()
+	if stats.Merges == 0 || stats.Partitions >= 200/32 {
+		t.Fatalf("expected partitions to merge, got %+v", stats)
+	}
+
+	if keys := collect(p, []byte("key000"), []byte("key999")); len(keys) != 5 || keys[0] != "key195" {
+		t.Fatalf("expected the 5 remaining keys, got %v", keys)
+	}
+}
+
+func TestPartitionedBST_EmptyKeys(t *testing.T) {
+	p := NewPartitioned(nil, 8)
+
+	defer func() {
+		p.Close()
+	}()
+
+	for i := 0; i < 8; i++ {
+		p.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("value"))
+	}
+
+	// Removing the only value leaves the key without values
+	p.Remove([]byte("key02"), []byte("value"))
+	p.Remove([]byte("key06"), []byte("value"))
+
+	// Split past the limit, then merge back after deletes
+	for i := 8; i < 20; i++ {
+		p.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("value"))
+	}
+
+	if p.PartitionStats().Splits == 0 {
+		t.Fatal("expected partitions to split")
+	}
+
+	for i := 8; i < 20; i++ {
+		p.Delete([]byte(fmt.Sprintf("key%02d", i)))
+	}
+
+	if p.PartitionStats().Merges == 0 {
+		t.Fatal("expected partitions to merge")
+	}
+
+	for _, k := range []string{"key02", "key06"} {
+		key := p.Get([]byte(k))
+		if key == nil || len(key.Values) != 0 {
+			t.Fatalf("expected %s to be kept without values", k)
+		}
+	}
+
+	if keys := collect(p, []byte("key00"), []byte("key99")); len(keys) != 8 {
+		t.Fatalf("expected 8 keys, got %v", keys)
+	}
+}
+
+func TestPartitionedBST_Metrics(t *testing.T) {
+	registry := NewRegistry()
+	p := NewPartitioned(nil, 8, WithMetrics(registry))
+
+	defer func() {
+		p.Close()
+	}()
+
+	for i := 0; i < 40; i++ {
+		p.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("value"))
+	}
+
+	// Replaced partitions no longer count towards the gauges
+	if registry.Gauge(MetricNodes) != 40 {
+		t.Fatalf("expected 40 nodes across the partitions, got %d", registry.Gauge(MetricNodes))
+	}
+
+	for i := 0; i < 38; i++ {
+		p.Delete([]byte(fmt.Sprintf("key%02d", i)))
+	}
+
+	if p.PartitionStats().Merges == 0 {
+		t.Fatal("expected partitions to merge")
+	}
+
+	if registry.Gauge(MetricNodes) != 2 {
+		t.Fatalf("expected 2 nodes across the partitions, got %d", registry.Gauge(MetricNodes))
+	}
+}
+
+func TestPartitionedBST_Concurrent(t *testing.T) {
+	p := NewPartitioned(nil, 16)
+
+	defer func() {
+		p.Close()
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				p.Put([]byte(fmt.Sprintf("key%d-%03d", w, i)), []byte("value"))
+			}
+		}(w)
+	}
+
+	// Stream ranges while partitions split
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			prev := ""
+			p.Range([]byte("key"), []byte("key~"), func(key *Key) bool {
+				if string(key.K) <= prev {
+					t.Errorf("expected keys in order, got %s after %s", key.K, prev)
+				}
+				prev = string(key.K)
+				return true
+			})
+		}
+	}()
+	wg.Wait()
+
+	if keys := collect(p, []byte("key"), []byte("key~")); len(keys) != 400 {
+		t.Fatalf("expected 400 keys, got %d", len(keys))
+	}
+}
@@ -0,0 +1,150 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import "bytes"
+
+// MinSharedPrefix is the shortest prefix shared with a parent's key which is compressed,
+// shorter prefixes cost more to track than they save
+const MinSharedPrefix = 8
+
+// WithPrefixCompression stores each new key relative to the key of the node it is linked under
+// when they share a prefix of at least MinSharedPrefix bytes, keeping only the rest of the key.
+// Keys are reconstructed for reads, which always return copies of compressed keys.
+func WithPrefixCompression() Option {
+	return func(bst *BST) {
+		bst.PrefixCompression = true
+	}
+}
+
+// compress stores key relative to parent when they share a long enough prefix.  key must not be linked yet.
+// The shared bytes are held in an immutable slice of their own rather than through the parent, so
+// deleting the parent frees its values and arena storage.  Keys share the parent's prefix slice where
+// it covers them, a new slice is only copied under keys which are not compressed themselves.
+func (bst *BST) compress(key, parent *Key) {
+	if !bst.PrefixCompression || parent == nil || key.prefix != nil {
+		return
+	}
+
+	n := parent.commonPrefix(key.stored())
+	if n < MinSharedPrefix {
+		return
+	}
+
+	var prefix []byte
+	if len(parent.prefix) >= MinSharedPrefix {
+		// Share the parent's prefix, or as much of it as the key shares
+		if n > len(parent.prefix) {
+			n = len(parent.prefix)
+		}
+		prefix = parent.prefix[:n:n]
+		key.size -= int64(n)
+	} else {
+		// The key owns the copy, its size is unchanged
+		prefix = append(make([]byte, 0, n), parent.stored()[:n]...)
+	}
+
+	if bst.Arena != nil {
+		// The suffix is the tail of the key's bytes, the shared ones are dropped by the next compaction.
+		// The state is only published to readers once the key is linked.
+		s := key.load()
+		s.key.off += uint32(n)
+		s.key.len -= uint32(n)
+	} else {
+		// Copy the suffix so the full key is not kept alive behind it
+		key.K = append(make([]byte, 0, len(key.K)-n), key.K[n:]...)
+	}
+	key.prefix = prefix
+}
+
+// stored returns the bytes the key stores, only those after the shared prefix if compressed.  With an
+// arena they are resolved from the key's state.
+func (k *Key) stored() []byte {
+	if k.K == nil {
+		if s := k.load(); s.table != nil {
+			return s.table.bytes(s.key)
+		}
+	}
+	return k.K
+}
+
+// compare compares the key with b, as bytes.Compare(key, b) would
+func (k *Key) compare(b []byte) int {
+	if k.prefix == nil {
+		return bytes.Compare(k.stored(), b)
+	}
+
+	n := len(k.prefix)
+	if len(b) < n {
+		// b is shorter than the shared prefix, the key is greater if b is a prefix of it
+		if c := bytes.Compare(k.prefix[:len(b)], b); c != 0 {
+			return c
+		}
+		return 1
+	}
+
+	if c := bytes.Compare(k.prefix, b[:n]); c != 0 {
+		return c
+	}
+	return bytes.Compare(k.stored(), b[n:])
+}
+
+// commonPrefix returns the length of the prefix shared by the key and b
+func (k *Key) commonPrefix(b []byte) int {
+	if k.prefix == nil {
+		return commonPrefix(k.stored(), b)
+	}
+
+	n := len(k.prefix)
+	if m := commonPrefix(k.prefix, b); m < n {
+		return m
+	}
+	return n + commonPrefix(k.stored(), b[n:])
+}
+
+// commonPrefix returns the length of the prefix shared by a and b
+func commonPrefix(a, b []byte) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// length returns the length of the key in bytes
+func (k *Key) length() int {
+	return len(k.prefix) + len(k.stored())
+}
+
+// bytes returns the key's bytes, reconstructed if the key is compressed
+func (k *Key) bytes() []byte {
+	if k.prefix == nil {
+		return k.stored()
+	}
+	return k.appendTo(make([]byte, 0, k.length()))
+}
+
+// appendTo appends the key's bytes to dst
+func (k *Key) appendTo(dst []byte) []byte {
+	return append(append(dst, k.prefix...), k.stored()...)
+}
@@ -0,0 +1,227 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// prefixKey returns a key sharing a long prefix with the others
+func prefixKey(i int) []byte {
+	return []byte(fmt.Sprintf("org/12345/project/67890/env/production/item/%08d", i))
+}
+
+func TestKey_CompareCompressed(t *testing.T) {
+	bst := New(WithPrefixCompression())
+
+	defer func() {
+		bst.Close()
+	}()
+
+	r := rand.New(rand.NewSource(1))
+	alphabet := []byte("ab")
+
+	// Build a chain of keys each compressed against the one before
+	var keys []*Key
+	var parent *Key
+	for i := 0; i < 50; i++ {
+		b := []byte("prefix/shared/")
+		for j := r.Intn(20); j > 0; j-- {
+			b = append(b, alphabet[r.Intn(len(alphabet))])
+		}
+
+		key := newKey(b)
+		if parent != nil {
+			bst.compress(key, parent)
+		}
+		keys = append(keys, key)
+		parent = key
+
+		if !bytes.Equal(key.bytes(), b) {
+			t.Fatalf("expected %s, got %s", b, key.bytes())
+		}
+	}
+
+	for _, key := range keys {
+		full := key.bytes()
+		for _, other := range keys {
+			b := other.bytes()
+			if key.compare(b) != bytes.Compare(full, b) {
+				t.Fatalf("compare %s with %s: expected %d, got %d", full, b, bytes.Compare(full, b), key.compare(b))
+			}
+
+			if key.commonPrefix(b) != commonPrefix(full, b) {
+				t.Fatalf("common prefix of %s and %s: expected %d, got %d", full, b, commonPrefix(full, b), key.commonPrefix(b))
+			}
+		}
+
+		// Shorter keys which are prefixes of the key
+		for n := 0; n < len(full); n++ {
+			if key.compare(full[:n]) != 1 {
+				t.Fatalf("expected %s to be greater than %s", full, full[:n])
+			}
+		}
+	}
+}
+
+func TestBST_PrefixCompression(t *testing.T) {
+	bst := New(WithPrefixCompression())
+
+	defer func() {
+		bst.Close()
+	}()
+
+	r := rand.New(rand.NewSource(1))
+	order := r.Perm(500)
+	for _, i := range order {
+		bst.Put(prefixKey(i), []byte("value"))
+	}
+
+	// wait for the tree to be built
+	time.Sleep(50 * time.Millisecond)
+
+	compressed := 0
+	bst.walk((*Node)(atomic.LoadPointer(&bst.Root)), func(key *Key) bool {
+		if key.prefix != nil {
+			compressed++
+		}
+		return true
+	})
+
+	if compressed != 499 {
+		t.Fatalf("expected every key but the root to be compressed, got %d", compressed)
+	}
+
+	for i := 0; i < 500; i += 7 {
+		key := bst.Get(prefixKey(i))
+		if key == nil || !bytes.Equal(key.K, prefixKey(i)) {
+			t.Fatalf("expected %s", prefixKey(i))
+		}
+	}
+
+	for i := 0; i < 500; i += 2 {
+		bst.Delete(prefixKey(i))
+	}
+
+	keys := bst.Range(prefixKey(0), prefixKey(499))
+	if len(keys) != 250 {
+		t.Fatalf("expected 250 keys, got %d", len(keys))
+	}
+
+	if !sort.SliceIsSorted(keys, func(i, j int) bool { return bytes.Compare(keys[i].K, keys[j].K) < 0 }) {
+		t.Fatal("expected keys in order")
+	}
+
+	for i, key := range keys {
+		if !bytes.Equal(key.K, prefixKey(2*i+1)) {
+			t.Fatalf("expected %s, got %s", prefixKey(2*i+1), key.K)
+		}
+	}
+
+	if keys := bst.GreaterThan(prefixKey(489)); len(keys) != 5 {
+		t.Fatalf("expected 5 keys, got %d", len(keys))
+	}
+
+	// Only the bytes after the shared prefix are stored
+	if stats := bst.MemoryStats(); stats.Bytes >= int64(250*(len(prefixKey(0))+5)) {
+		t.Fatalf("expected compressed keys to take less than their full size, got %d bytes", stats.Bytes)
+	}
+}
+
+func TestBST_PrefixParentFreed(t *testing.T) {
+	bst := New(WithPrefixCompression(), WithZeroCopy())
+
+	defer func() {
+		bst.Close()
+	}()
+
+	var freed int32
+	value := make([]byte, 1<<20)
+	runtime.SetFinalizer(&value[0], func(*byte) {
+		atomic.StoreInt32(&freed, 1)
+	})
+
+	bst.PutOffQueue([]byte("prefix/shared/m"), value)
+	bst.PutOffQueue([]byte("prefix/shared/a"), []byte("a"))
+	bst.PutOffQueue([]byte("prefix/shared/z"), []byte("z"))
+	value = nil
+
+	// The children are compressed against the parent, deleting it must not keep its value alive
+	if !bst.Delete([]byte("prefix/shared/m")) {
+		t.Fatal("expected the parent to be deleted")
+	}
+
+	for i := 0; i < 10 && atomic.LoadInt32(&freed) == 0; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if atomic.LoadInt32(&freed) == 0 {
+		t.Fatal("expected the deleted parent's value to be collected")
+	}
+
+	for _, k := range []string{"prefix/shared/a", "prefix/shared/z"} {
+		if key := bst.Get([]byte(k)); key == nil || string(key.K) != k {
+			t.Fatalf("expected %s", k)
+		}
+	}
+}
+
+func BenchmarkBST_PrefixHeavy(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		opts []Option
+	}{
+		{"Plain", nil},
+		{"Compressed", []Option{WithPrefixCompression()}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			const n = 100000
+			order := rand.New(rand.NewSource(1)).Perm(n)
+			keys := make([][]byte, n)
+			for i, j := range order {
+				keys[i] = prefixKey(j)
+			}
+			value := []byte("value")
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				bst := New(bench.opts...)
+				for _, key := range keys {
+					bst.PutOffQueue(key, value)
+				}
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/n, "heap-B/key")
+				b.ReportMetric(float64(bst.MemoryStats().Bytes)/n, "stored-B/key")
+				bst.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// QueuePolicy is how writes are handled while the write queue is full
+type QueuePolicy int
+
+const (
+	QueueBlock      QueuePolicy = iota // Wait for space in the queue
+	QueueFail                          // Reject the write with ErrQueueFull
+	QueueDropOldest                    // Drop the oldest queued write to make room
+)
+
+// Metric names for the write queue
+const (
+	MetricQueueRejected = "bst_write_queue_rejected_total" // Writes rejected because the queue was full
+	MetricQueueDropped  = "bst_write_queue_dropped_total"  // Queued writes dropped to make room for newer ones
+)
+
+// WithQueueCapacity bounds each writer's queue to capacity writes, handling writes to a full queue according to policy
+func WithQueueCapacity(capacity int, policy QueuePolicy) Option {
+	return func(bst *BST) {
+		bst.QueueCapacity = capacity
+		bst.QueuePolicy = policy
+	}
+}
+
+// WithWriters sets the number of background writers.  Writes are partitioned between the writers
+// by a hash of their key so writes to the same key are applied in order.
+func WithWriters(n int) Option {
+	return func(bst *BST) {
+		bst.Writers = n
+	}
+}
+
+// writer is a background writer and its write queue
+type writer struct {
+	queue *WriteQueue   // Queued writes
+	lock  *sync.Mutex   // Mutex for the queue
+	wake  chan struct{} // Signals the writer that writes are queued
+	space chan struct{} // Closed and replaced each time space frees in a full queue
+}
+
+// initWriters creates the background writers, the first uses the tree's WriteQueue, WriteQueueLock and Wake
+func (bst *BST) initWriters() {
+	bst.writers = []*writer{{queue: &bst.WriteQueue, lock: bst.WriteQueueLock, wake: bst.Wake, space: make(chan struct{})}}
+	for i := 1; i < bst.Writers; i++ {
+		bst.writers = append(bst.writers, &writer{queue: &WriteQueue{}, lock: &sync.Mutex{}, wake: make(chan struct{}, 1), space: make(chan struct{})})
+	}
+}
+
+// writerFor returns the writer a key's writes are partitioned to
+func (bst *BST) writerFor(key []byte) *writer {
+	if len(bst.writers) == 1 {
+		return bst.writers[0]
+	}
+
+	// FNV-1a
+	h := uint32(2166136261)
+	for _, b := range key {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return bst.writers[h%uint32(len(bst.writers))]
+}
+
+// enqueue adds an operation to its writer's queue and wakes the writer.  With QueueBlock it waits
+// for space until ctx is done, returning ctx's error, or the tree is closed, returning ErrClosed.
+func (bst *BST) enqueue(ctx context.Context, op *Operation) error {
+	w := bst.writerFor(op.Key)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for bst.QueueCapacity > 0 && w.queue.Size() >= bst.QueueCapacity {
+		switch bst.QueuePolicy {
+		case QueueFail:
+			bst.incr(MetricQueueRejected, 1)
+			return ErrQueueFull
+		case QueueDropOldest:
+			dropped := w.queue.Dequeue()
+			if dropped.result != nil {
+				// Release the caller waiting for the dropped write
+				dropped.result <- ErrQueueFull
+			} else {
+				releaseOperation(dropped)
+			}
+			atomic.AddInt64(&bst.queued, -1)
+			bst.incr(MetricQueueDropped, 1)
+			continue
+		}
+
+		// Wait for the background writer to free space
+		space := w.space
+		w.lock.Unlock()
+		select {
+		case <-space:
+		case <-ctx.Done():
+			w.lock.Lock()
+			return ctx.Err()
+		case <-bst.Exit:
+			w.lock.Lock()
+			return ErrClosed
+		}
+		w.lock.Lock()
+	}
+
+	// Enqueue the write operation
+	w.queue.EnqueueOperation(op)
+	bst.gauge(MetricQueueDepth, atomic.AddInt64(&bst.queued, 1))
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+		// Already signalled
+	}
+	return nil
+}
+
+// signalSpace wakes producers waiting for space in w's full queue.  The writer's lock must be held.
+func (bst *BST) signalSpace(w *writer) {
+	if bst.QueueCapacity > 0 && w.queue.Size() == bst.QueueCapacity-1 {
+		close(w.space)
+		w.space = make(chan struct{})
+	}
+}
@@ -0,0 +1,367 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newStalledBST creates a tree without a background writer so queued writes stay queued
+func newStalledBST(opts ...Option) *BST {
+	bst := &BST{WriteQueueLock: &sync.Mutex{}, Exit: make(chan struct{}), Wake: make(chan struct{}, 1), Writers: 1}
+	for _, opt := range opts {
+		opt(bst)
+	}
+	bst.initWriters()
+	return bst
+}
+
+func TestWriteQueue(t *testing.T) {
+	q := WriteQueue{}
+
+	next := 0
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 100; i++ {
+			q.Enqueue([]byte(fmt.Sprintf("key%03d", round*100+i)), nil)
+		}
+
+		for i := 0; i < 60; i++ {
+			op := q.Dequeue()
+			if string(op.Key) != fmt.Sprintf("key%03d", next) {
+				t.Fatalf("expected key%03d, got %s", next, op.Key)
+			}
+			next++
+		}
+	}
+
+	if q.Size() != 160 {
+		t.Fatalf("expected 160 queued writes, got %d", q.Size())
+	}
+
+	for !q.IsEmpty() {
+		op := q.Dequeue()
+		if string(op.Key) != fmt.Sprintf("key%03d", next) {
+			t.Fatalf("expected key%03d, got %s", next, op.Key)
+		}
+		next++
+	}
+
+	if len(q.items) != minWriteQueueSize {
+		t.Fatalf("expected the ring buffer to shrink to %d, got %d", minWriteQueueSize, len(q.items))
+	}
+}
+
+func TestBST_QueueFail(t *testing.T) {
+	registry := NewRegistry()
+	bst := newStalledBST(WithQueueCapacity(2, QueueFail), WithMetrics(registry))
+
+	bst.Put([]byte("key1"), []byte("value"))
+	bst.Put([]byte("key2"), []byte("value"))
+
+	if err := bst.Checked().Put([]byte("key3"), []byte("value")); err != ErrQueueFull {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+
+	if err := bst.PutContext(context.Background(), []byte("key3"), []byte("value")); err != ErrQueueFull {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+
+	if registry.Counter(MetricQueueRejected) != 2 {
+		t.Fatal("expected 2 rejected writes")
+	}
+
+	if registry.Gauge(MetricQueueDepth) != 2 {
+		t.Fatal("expected a queue depth of 2")
+	}
+}
+
+func TestBST_QueueDropOldest(t *testing.T) {
+	bst := newStalledBST(WithQueueCapacity(2, QueueDropOldest))
+
+	for i := 1; i <= 3; i++ {
+		bst.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value"))
+	}
+
+	for i := 2; i <= 3; i++ {
+		if !bst.writeNext(bst.writers[0]) {
+			t.Fatal("expected a queued write")
+		}
+
+		if bst.Get([]byte(fmt.Sprintf("key%d", i))) == nil {
+			t.Fatalf("expected key%d to be written", i)
+		}
+	}
+
+	if bst.writeNext(bst.writers[0]) || bst.Get([]byte("key1")) != nil {
+		t.Fatal("expected key1 to have been dropped")
+	}
+}
+
+func TestBST_QueueBlock(t *testing.T) {
+	bst := newStalledBST(WithQueueCapacity(1, QueueBlock))
+
+	bst.Put([]byte("key1"), []byte("value"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := bst.PutContext(ctx, []byte("key2"), []byte("value")); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bst.Put([]byte("key2"), []byte("value"))
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("expected put to block while the queue is full")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	bst.writeNext(bst.writers[0])
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected put to complete once space freed")
+	}
+
+	if bst.WriteQueue.Size() != 1 {
+		t.Fatal("expected key2 to be queued")
+	}
+
+	// Closing the tree releases blocked writers
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(bst.Exit)
+	}()
+
+	if err := bst.Checked().Put([]byte("key3"), []byte("value")); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestBST_Writers(t *testing.T) {
+	bst := New(WithWriters(4))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	if len(bst.writers) != 4 {
+		t.Fatalf("expected 4 writers, got %d", len(bst.writers))
+	}
+
+	for i := 0; i < 100; i++ {
+		bst.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("value"))
+		bst.Put([]byte("key"), []byte(fmt.Sprintf("value%02d", i)))
+	}
+
+	// wait for the tree to be built
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		if bst.Get([]byte(fmt.Sprintf("key%02d", i))) == nil {
+			t.Fatalf("expected key%02d to be written", i)
+		}
+	}
+
+	// Writes to the same key are applied in order
+	key := bst.Get([]byte("key"))
+	for i, v := range key.Values {
+		if string(v) != fmt.Sprintf("value%02d", i) {
+			t.Fatalf("expected value%02d, got %s", i, v)
+		}
+	}
+}
+
+func TestBST_MixedOperationOrder(t *testing.T) {
+	bst := New(WithWriters(4))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	// Removes and deletes apply after the puts queued before them, without waiting for the tree to be built
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%02d", i))
+		bst.Put(key, []byte("value"))
+		bst.Put(key, []byte("value 2"))
+
+		if !bst.Remove(key, []byte("value")) {
+			t.Fatalf("expected value to be removed from %s", key)
+		}
+
+		if i%2 == 0 {
+			if !bst.Delete(key) {
+				t.Fatalf("expected %s to be deleted", key)
+			}
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		key := bst.Get([]byte(fmt.Sprintf("key%02d", i)))
+		if i%2 == 0 {
+			if key != nil {
+				t.Fatalf("expected key%02d to be deleted", i)
+			}
+			continue
+		}
+
+		if key == nil || len(key.Values) != 1 || string(key.Values[0]) != "value 2" {
+			t.Fatalf("expected key%02d to hold only value 2", i)
+		}
+	}
+}
+
+func TestBST_PutThenPutIfAbsent(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.Put([]byte("key"), []byte("a"))
+	if bst.PutIfAbsent([]byte("key"), []byte("b")) {
+		t.Fatalf("expected PutIfAbsent to see the queued put")
+	}
+
+	key := bst.Get([]byte("key"))
+	if key == nil || len(key.Values) != 1 || string(key.Values[0]) != "a" {
+		t.Fatalf("expected only the queued value")
+	}
+}
+
+func TestBST_PutThenSet(t *testing.T) {
+	bst := New(WithValueMode(ValueMap))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.Put([]byte("key"), []byte("old"))
+	prev, ok := bst.Set([]byte("key"), []byte("new"))
+	if !ok || string(prev) != "old" {
+		t.Fatalf("expected Set to replace the queued value, got %q", prev)
+	}
+
+	key := bst.Get([]byte("key"))
+	if key == nil || len(key.Values) != 1 || string(key.Values[0]) != "new" {
+		t.Fatalf("expected the set value")
+	}
+}
+
+func TestBST_PutThenCompareAndSwap(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.Put([]byte("key"), []byte("a"))
+	if !bst.CompareAndSwap([]byte("key"), [][]byte{[]byte("a")}, [][]byte{[]byte("b")}) {
+		t.Fatalf("expected the swap to see the queued put")
+	}
+
+	bst.Put([]byte("key"), []byte("c"))
+	if bst.CompareAndSwap([]byte("key"), [][]byte{[]byte("b")}, [][]byte{[]byte("d")}) {
+		t.Fatalf("expected the swap to fail after the queued put")
+	}
+}
+
+func TestBST_PutThenDeleteIfValues(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.Put([]byte("key"), []byte("a"))
+	bst.Put([]byte("key"), []byte("b"))
+	if bst.DeleteIfValues([]byte("key"), [][]byte{[]byte("a")}) {
+		t.Fatalf("expected the delete to see both queued puts")
+	}
+
+	if !bst.DeleteIfValues([]byte("key"), [][]byte{[]byte("a"), []byte("b")}) {
+		t.Fatalf("expected the key to be deleted")
+	}
+
+	if bst.Get([]byte("key")) != nil {
+		t.Fatalf("expected the key to be gone")
+	}
+}
+
+func TestBST_PutThenCompute(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	for i := 0; i < 10; i++ {
+		bst.Put([]byte("key"), []byte(fmt.Sprintf("value%d", i)))
+	}
+
+	values, ok := bst.Compute([]byte("key"), func(old [][]byte, exists bool) ([][]byte, bool) {
+		return [][]byte{[]byte(fmt.Sprintf("%d", len(old)))}, true
+	})
+	if !ok || len(values) != 1 || string(values[0]) != "10" {
+		t.Fatalf("expected Compute to see all 10 queued puts, got %q", values)
+	}
+}
+
+// benchmarkWriters puts b.N keys from parallel producers and waits until they have all been applied
+func benchmarkWriters(b *testing.B, writers int) {
+	bst := New(WithWriters(writers), WithReapInterval(0))
+	defer bst.Close()
+
+	keys := make([][]byte, b.N)
+	for i, n := range rand.New(rand.NewSource(1)).Perm(b.N) {
+		keys[i] = []byte(fmt.Sprintf("key%010d", n))
+	}
+
+	var next int64 = -1
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			bst.Put(keys[atomic.AddInt64(&next, 1)], []byte("value"))
+		}
+	})
+
+	for atomic.LoadInt64(&bst.nodes) < int64(b.N) {
+		runtime.Gosched()
+	}
+}
+
+func BenchmarkBST_Put1Writer(b *testing.B) {
+	benchmarkWriters(b, 1)
+}
+
+func BenchmarkBST_PutNWriters(b *testing.B) {
+	benchmarkWriters(b, runtime.GOMAXPROCS(0))
+}
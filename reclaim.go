@@ -0,0 +1,113 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Metric names reported by node reclamation
+const (
+	MetricNodesRetired   = "bst_nodes_retired"         // Unlinked nodes waiting until no reader can observe them
+	MetricNodesReclaimed = "bst_nodes_reclaimed_total" // Unlinked nodes recycled for new keys
+)
+
+// epochs is the number of epochs tracked at once.  A node retired in epoch e is reclaimed once the
+// global epoch reaches e+2, by which point every reader pinned in e or earlier has unpinned.
+const epochs = 3
+
+// reclaimer implements epoch based reclamation so nodes unlinked by delete are only recycled
+// once no reader traversing the tree can still hold a pointer to them
+type reclaimer struct {
+	epoch   uint64          // Global epoch
+	active  [epochs]int64   // Readers pinned in each epoch, indexed by epoch modulo epochs
+	lock    sync.Mutex      // Guards retired and advancing the epoch
+	retired [epochs][]*Node // Nodes unlinked in each epoch awaiting reclamation
+	pending int64           // Nodes within retired
+	pool    sync.Pool       // Reclaimed nodes ready for reuse, see newNode
+}
+
+// pin registers a reader in the current epoch, returning the epoch to pass to unpin.
+// Nodes reached from the root while pinned are not reclaimed until the reader unpins.
+func (bst *BST) pin() uint64 {
+	r := &bst.reclaim
+	for {
+		e := atomic.LoadUint64(&r.epoch)
+		atomic.AddInt64(&r.active[e%epochs], 1)
+
+		// The epoch advanced before the reader was counted, register in the new epoch
+		if atomic.LoadUint64(&r.epoch) == e {
+			return e
+		}
+		atomic.AddInt64(&r.active[e%epochs], -1)
+	}
+}
+
+// unpin unregisters a reader pinned in epoch e
+func (bst *BST) unpin(e uint64) {
+	atomic.AddInt64(&bst.reclaim.active[e%epochs], -1)
+}
+
+// retire queues a node unlinked from the tree for reclamation.  The caller must be pinned.
+func (bst *BST) retire(node *Node) {
+	r := &bst.reclaim
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	e := atomic.LoadUint64(&r.epoch) % epochs
+	r.retired[e] = append(r.retired[e], node)
+	r.pending++
+	bst.gauge(MetricNodesRetired, r.pending)
+}
+
+// advance moves the global epoch forward as far as pinned readers allow, reclaiming the nodes
+// retired two epochs before each new epoch
+func (bst *BST) advance() {
+	r := &bst.reclaim
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i := 0; i < epochs && r.pending > 0; i++ {
+		e := atomic.LoadUint64(&r.epoch)
+
+		// Readers pinned in the previous epoch may still observe nodes retired in it
+		if atomic.LoadInt64(&r.active[(e+epochs-1)%epochs]) != 0 {
+			return
+		}
+
+		// The slot of the next epoch holds the nodes retired in e-2, unreachable by every pinned reader
+		next := (e + 1) % epochs
+		if n := len(r.retired[next]); n > 0 {
+			for _, node := range r.retired[next] {
+				bst.releaseNode(node)
+			}
+			r.retired[next] = r.retired[next][:0]
+			r.pending -= int64(n)
+			bst.incr(MetricNodesReclaimed, int64(n))
+			bst.gauge(MetricNodesRetired, r.pending)
+		}
+
+		atomic.StoreUint64(&r.epoch, e+1)
+	}
+}
+
+// find looks up a key while pinned so the nodes traversed are not reclaimed
+func (bst *BST) find(key []byte) *Key {
+	defer bst.unpin(bst.pin())
+	return bst.get((*Node)(atomic.LoadPointer(&bst.Root)), key)
+}
@@ -0,0 +1,150 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBST_Reclaim(t *testing.T) {
+	registry := NewRegistry()
+	bst := New(WithMetrics(registry))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	for i := 0; i < 10; i++ {
+		bst.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("value"))
+	}
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	for i := 0; i < 10; i += 2 {
+		bst.Delete([]byte(fmt.Sprintf("key%02d", i)))
+	}
+
+	// With no reader pinned every unlinked node is recycled
+	if registry.Counter(MetricNodesReclaimed) != 5 {
+		t.Fatalf("expected 5 nodes reclaimed, got %d", registry.Counter(MetricNodesReclaimed))
+	}
+
+	if registry.Gauge(MetricNodesRetired) != 0 {
+		t.Fatalf("expected no nodes awaiting reclamation, got %d", registry.Gauge(MetricNodesRetired))
+	}
+
+	// Reclaimed nodes are reused for new keys
+	for i := 0; i < 10; i += 2 {
+		bst.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("value"))
+	}
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	keys := bst.Range([]byte("key00"), []byte("key09"))
+	if len(keys) != 10 {
+		t.Fatalf("expected 10 keys, got %d", len(keys))
+	}
+}
+
+func TestBST_ReclaimPinned(t *testing.T) {
+	registry := NewRegistry()
+	bst := New(WithMetrics(registry))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.Put([]byte("key"), []byte("value"))
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	// A pinned reader holding the node keeps it from being recycled
+	e := bst.pin()
+	node := (*Node)(atomic.LoadPointer(&bst.Root))
+
+	if !bst.Delete([]byte("key")) {
+		t.Fatal("expected key to be deleted")
+	}
+
+	if registry.Counter(MetricNodesReclaimed) != 0 {
+		t.Fatalf("expected no nodes reclaimed while pinned, got %d", registry.Counter(MetricNodesReclaimed))
+	}
+
+	if node.Key == nil || !bytes.Equal(node.Key.K, []byte("key")) {
+		t.Fatal("expected the pinned node to be intact")
+	}
+
+	bst.unpin(e)
+	bst.advance()
+
+	if registry.Counter(MetricNodesReclaimed) != 1 {
+		t.Fatalf("expected 1 node reclaimed after unpinning, got %d", registry.Counter(MetricNodesReclaimed))
+	}
+}
+
+func TestBST_ReclaimConcurrent(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Readers check every key they reach is one that was written while nodes are recycled underneath them
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				for _, key := range bst.Range([]byte("key000"), []byte("key999")) {
+					if !bytes.HasPrefix(key.K, []byte("key")) {
+						t.Errorf("unexpected key %q", key.K)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 50; i++ {
+			bst.PutOffQueue([]byte(fmt.Sprintf("key%03d", i)), []byte("value"))
+		}
+		for i := 0; i < 50; i++ {
+			bst.deleteKey([]byte(fmt.Sprintf("key%03d", i)), nil)
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,120 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+)
+
+// DefaultRenderDepth is the depth Render stops descending at
+const DefaultRenderDepth = 16
+
+// WriteDOT writes the tree structure as a Graphviz DOT graph, an empty graph for an empty tree
+func (bst *BST) WriteDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	// Box nodes take labels as plain text, record nodes would parse |{}<> in keys as fields
+	bw.WriteString("digraph bst {\n")
+	bw.WriteString("\tnode [shape=box];\n")
+
+	defer bst.unpin(bst.pin())
+
+	if root := (*Node)(atomic.LoadPointer(&bst.Root)); root != nil {
+		id := 0
+		bst.writeDOT(bw, root, &id)
+	}
+
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// writeDOT writes node and its subtrees, returning the id assigned to node
+func (bst *BST) writeDOT(w *bufio.Writer, node *Node, id *int) int {
+	nodeID := *id
+	*id++
+
+	fmt.Fprintf(w, "\tn%d [label=%s];\n", nodeID, strconv.Quote(string(node.key().bytes())))
+
+	if left := node.left(); left != nil {
+		leftID := bst.writeDOT(w, left, id)
+		fmt.Fprintf(w, "\tn%d -> n%d [label=\"L\"];\n", nodeID, leftID)
+	}
+
+	if right := node.right(); right != nil {
+		rightID := bst.writeDOT(w, right, id)
+		fmt.Fprintf(w, "\tn%d -> n%d [label=\"R\"];\n", nodeID, rightID)
+	}
+
+	return nodeID
+}
+
+// Render writes the tree structure as an ASCII tree up to DefaultRenderDepth levels deep
+func (bst *BST) Render(w io.Writer) error {
+	return bst.RenderDepth(w, DefaultRenderDepth)
+}
+
+// RenderDepth writes the tree structure as an ASCII tree up to depth levels deep.
+// Subtrees below the depth limit are shown as an ellipsis.
+func (bst *BST) RenderDepth(w io.Writer, depth int) error {
+	bw := bufio.NewWriter(w)
+
+	defer bst.unpin(bst.pin())
+	root := (*Node)(atomic.LoadPointer(&bst.Root))
+	if root == nil {
+		bw.WriteString("(empty)\n")
+		return bw.Flush()
+	}
+
+	bw.WriteString(string(root.key().bytes()) + "\n")
+	bst.render(bw, root, "", depth-1)
+
+	return bw.Flush()
+}
+
+// render writes the children of node, each line prefixed with prefix
+func (bst *BST) render(w *bufio.Writer, node *Node, prefix string, depth int) {
+	left := node.left()
+	right := node.right()
+
+	if left == nil && right == nil {
+		return
+	}
+
+	if depth <= 0 {
+		w.WriteString(prefix + "└── …\n")
+		return
+	}
+
+	if left != nil {
+		branch, indent := "├── ", "│   "
+		if right == nil {
+			branch, indent = "└── ", "    "
+		}
+
+		w.WriteString(prefix + branch + "L: " + string(left.key().bytes()) + "\n")
+		bst.render(w, left, prefix+indent, depth-1)
+	}
+
+	if right != nil {
+		w.WriteString(prefix + "└── R: " + string(right.key().bytes()) + "\n")
+		bst.render(w, right, prefix+"    ", depth-1)
+	}
+}
@@ -0,0 +1,146 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBST_WriteDOT(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.Put([]byte("m"), []byte("value"))
+	bst.Put([]byte("c"), []byte("value"))
+	bst.Put([]byte("x"), []byte("value"))
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := bst.WriteDOT(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := "digraph bst {\n" +
+		"\tnode [shape=box];\n" +
+		"\tn0 [label=\"m\"];\n" +
+		"\tn1 [label=\"c\"];\n" +
+		"\tn0 -> n1 [label=\"L\"];\n" +
+		"\tn2 [label=\"x\"];\n" +
+		"\tn0 -> n2 [label=\"R\"];\n" +
+		"}\n"
+
+	if buf.String() != expect {
+		t.Fatalf("expected\n%s\ngot\n%s", expect, buf.String())
+	}
+}
+
+func TestBST_WriteDOTEmpty(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	var buf bytes.Buffer
+	if err := bst.WriteDOT(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := "digraph bst {\n\tnode [shape=box];\n}\n"
+	if buf.String() != expect {
+		t.Fatalf("expected\n%s\ngot\n%s", expect, buf.String())
+	}
+}
+
+func TestBST_WriteDOTLabels(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.PutOffQueue([]byte(`a|{b}<c>"d"`), []byte("value"))
+
+	var buf bytes.Buffer
+	if err := bst.WriteDOT(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), `[label="a|{b}<c>\"d\""]`) || strings.Contains(buf.String(), "record") {
+		t.Fatalf("expected a plain quoted label, got\n%s", buf.String())
+	}
+}
+
+func TestBST_Render(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	for _, k := range []string{"m", "c", "x", "a", "e", "z"} {
+		bst.Put([]byte(k), []byte("value"))
+	}
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := bst.Render(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := strings.Join([]string{
+		"m",
+		"├── L: c",
+		"│   ├── L: a",
+		"│   └── R: e",
+		"└── R: x",
+		"    └── R: z",
+		"",
+	}, "\n")
+
+	if buf.String() != expect {
+		t.Fatalf("expected\n%s\ngot\n%s", expect, buf.String())
+	}
+
+	buf.Reset()
+	if err := bst.RenderDepth(&buf, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	expect = strings.Join([]string{
+		"m",
+		"├── L: c",
+		"│   └── …",
+		"└── R: x",
+		"    └── …",
+		"",
+	}, "\n")
+
+	if buf.String() != expect {
+		t.Fatalf("expected\n%s\ngot\n%s", expect, buf.String())
+	}
+}
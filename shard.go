@@ -0,0 +1,363 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"hash/maphash"
+	"sort"
+	"sync"
+)
+
+// ShardMode is how a ShardedBST partitions keys between its shards
+type ShardMode int
+
+const (
+	ShardHash  ShardMode = iota // Keys are spread by hash, range queries merge the results of every shard
+	ShardRange                  // Keys are split by range, range queries only visit the shards they overlap
+)
+
+// ShardedBST partitions keys across independent trees, each with its own root and background writers
+type ShardedBST struct {
+	Shards []*BST       // Trees holding the keys, in key order with ShardRange
+	Mode   ShardMode    // How keys are partitioned
+	Splits [][]byte     // With ShardRange shard i holds keys from Splits[i-1] up to but excluding Splits[i]
+	seed   maphash.Seed // Seed hashing keys to shards with ShardHash
+}
+
+// NewSharded creates n trees, each configured by opts, with keys spread between them by hash.  Shards
+// given the same metrics by WithMetrics add to its counters and histograms, and report each gauge as
+// the sum across the shards.
+func NewSharded(n int, opts ...Option) *ShardedBST {
+	if n < 1 {
+		n = 1
+	}
+
+	opts = withGaugeSum(opts)
+
+	s := &ShardedBST{Mode: ShardHash, seed: maphash.MakeSeed()}
+	for i := 0; i < n; i++ {
+		s.Shards = append(s.Shards, New(opts...))
+	}
+	return s
+}
+
+// NewRangeSharded creates a tree per range between splits, each configured by opts, so ordered scans
+// only visit the shards they overlap.  Splits are sorted and duplicates ignored.  Metrics are reported
+// as by NewSharded.
+func NewRangeSharded(splits [][]byte, opts ...Option) *ShardedBST {
+	sorted := make([][]byte, 0, len(splits))
+	for _, split := range splits {
+		sorted = append(sorted, append([]byte(nil), split...))
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+
+	s := &ShardedBST{Mode: ShardRange}
+	for i, split := range sorted {
+		if i == 0 || !bytes.Equal(split, sorted[i-1]) {
+			s.Splits = append(s.Splits, split)
+		}
+	}
+
+	opts = withGaugeSum(opts)
+	for i := 0; i <= len(s.Splits); i++ {
+		s.Shards = append(s.Shards, New(opts...))
+	}
+	return s
+}
+
+// gaugeSum sums the gauges set by several trees sharing metrics, so each gauge reports the total
+// across the trees rather than the value of whichever tree set it last
+type gaugeSum struct {
+	lock   sync.Mutex       // Held while updating a total
+	totals map[string]int64 // Sum of each gauge across the trees
+}
+
+// treeGauges reports a single tree's instrumentation to metrics shared through a gaugeSum
+type treeGauges struct {
+	Metrics                  // Shared metrics, counters and histograms are passed through
+	sum     *gaugeSum        // Totals across the trees
+	values  map[string]int64 // The tree's own value of each gauge, guarded by sum.lock
+}
+
+// withGaugeSum returns opts followed by an option reporting the tree's metrics through a gaugeSum
+// shared by every tree created with the returned options
+func withGaugeSum(opts []Option) []Option {
+	sum := &gaugeSum{totals: make(map[string]int64)}
+	return append(opts[:len(opts):len(opts)], func(bst *BST) {
+		if bst.Metrics != nil {
+			bst.Metrics = &treeGauges{Metrics: bst.Metrics, sum: sum, values: make(map[string]int64)}
+		}
+	})
+}
+
+// Set sets the tree's gauge and the shared gauge to the total across the trees
+func (m *treeGauges) Set(name string, value int64) {
+	m.sum.lock.Lock()
+	defer m.sum.lock.Unlock()
+
+	total := m.sum.totals[name] + value - m.values[name]
+	m.values[name] = value
+	m.sum.totals[name] = total
+	m.Metrics.Set(name, total)
+}
+
+// releaseGauges removes the gauges of a closed tree from the totals it reported to
+func releaseGauges(bst *BST) {
+	m, ok := bst.Metrics.(*treeGauges)
+	if !ok {
+		return
+	}
+
+	m.sum.lock.Lock()
+	defer m.sum.lock.Unlock()
+
+	for name, value := range m.values {
+		m.sum.totals[name] -= value
+		m.Metrics.Set(name, m.sum.totals[name])
+	}
+	m.values = make(map[string]int64)
+}
+
+// Shard returns the tree holding key
+func (s *ShardedBST) Shard(key []byte) *BST {
+	return s.Shards[s.shardIndex(key)]
+}
+
+// shardIndex returns the index of the shard holding key
+func (s *ShardedBST) shardIndex(key []byte) int {
+	if s.Mode == ShardRange {
+		return sort.Search(len(s.Splits), func(i int) bool {
+			return bytes.Compare(s.Splits[i], key) > 0
+		})
+	}
+
+	if len(s.Shards) == 1 {
+		return 0
+	}
+	return int(maphash.Bytes(s.seed, key) % uint64(len(s.Shards)))
+}
+
+// Put queues a value to be added to a key on its shard
+func (s *ShardedBST) Put(key, value []byte) {
+	s.Shard(key).Put(key, value)
+}
+
+// PutOffQueue adds a value to a key on its shard immediately
+func (s *ShardedBST) PutOffQueue(key, value []byte) {
+	s.Shard(key).PutOffQueue(key, value)
+}
+
+// Set replaces the values of a key with a single value, returning the previous value
+func (s *ShardedBST) Set(key, value []byte) ([]byte, bool) {
+	return s.Shard(key).Set(key, value)
+}
+
+// Get retrieves a key from its shard
+func (s *ShardedBST) Get(key []byte) *Key {
+	return s.Shard(key).Get(key)
+}
+
+// Remove removes a value from a key, returning whether it was removed
+func (s *ShardedBST) Remove(key, value []byte) bool {
+	return s.Shard(key).Remove(key, value)
+}
+
+// Delete removes a key, returning whether it was removed
+func (s *ShardedBST) Delete(key []byte) bool {
+	return s.Shard(key).Delete(key)
+}
+
+// Range retrieves all keys within a range in order
+func (s *ShardedBST) Range(start, end []byte) []*Key {
+	keys, _ := s.RangeContext(context.Background(), start, end)
+	return keys
+}
+
+// RangeContext retrieves all keys within a range in order, returning ctx's error if it is done before the traversal completes
+func (s *ShardedBST) RangeContext(ctx context.Context, start, end []byte) ([]*Key, error) {
+	if bytes.Compare(start, end) > 0 {
+		return nil, ctx.Err()
+	}
+
+	return s.query(ctx, s.shardIndex(start), s.shardIndex(end), func(bst *BST) ([]*Key, error) {
+		return bst.RangeContext(ctx, start, end)
+	})
+}
+
+// GreaterThan retrieves all keys greater than the specified key in order
+func (s *ShardedBST) GreaterThan(key []byte) []*Key {
+	keys, _ := s.GreaterThanContext(context.Background(), key)
+	return keys
+}
+
+// GreaterThanContext retrieves all keys greater than the specified key in order, returning ctx's error if it is done before the traversal completes
+func (s *ShardedBST) GreaterThanContext(ctx context.Context, key []byte) ([]*Key, error) {
+	return s.query(ctx, s.shardIndex(key), len(s.Shards)-1, func(bst *BST) ([]*Key, error) {
+		return bst.GreaterThanContext(ctx, key)
+	})
+}
+
+// GreaterThanEq retrieves all keys greater than or equal to the specified key in order
+func (s *ShardedBST) GreaterThanEq(key []byte) []*Key {
+	keys, _ := s.GreaterThanEqContext(context.Background(), key)
+	return keys
+}
+
+// GreaterThanEqContext retrieves all keys greater than or equal to the specified key in order, returning ctx's error if it is done before the traversal completes
+func (s *ShardedBST) GreaterThanEqContext(ctx context.Context, key []byte) ([]*Key, error) {
+	return s.query(ctx, s.shardIndex(key), len(s.Shards)-1, func(bst *BST) ([]*Key, error) {
+		return bst.GreaterThanEqContext(ctx, key)
+	})
+}
+
+// LessThan retrieves all keys less than the specified key in order
+func (s *ShardedBST) LessThan(key []byte) []*Key {
+	keys, _ := s.LessThanContext(context.Background(), key)
+	return keys
+}
+
+// LessThanContext retrieves all keys less than the specified key in order, returning ctx's error if it is done before the traversal completes
+func (s *ShardedBST) LessThanContext(ctx context.Context, key []byte) ([]*Key, error) {
+	return s.query(ctx, 0, s.shardIndex(key), func(bst *BST) ([]*Key, error) {
+		return bst.LessThanContext(ctx, key)
+	})
+}
+
+// LessThanEq retrieves all keys less than or equal to the specified key in order
+func (s *ShardedBST) LessThanEq(key []byte) []*Key {
+	keys, _ := s.LessThanEqContext(context.Background(), key)
+	return keys
+}
+
+// LessThanEqContext retrieves all keys less than or equal to the specified key in order, returning ctx's error if it is done before the traversal completes
+func (s *ShardedBST) LessThanEqContext(ctx context.Context, key []byte) ([]*Key, error) {
+	return s.query(ctx, 0, s.shardIndex(key), func(bst *BST) ([]*Key, error) {
+		return bst.LessThanEqContext(ctx, key)
+	})
+}
+
+// NGet retrieves all keys except the specified key in order
+func (s *ShardedBST) NGet(key []byte) []*Key {
+	keys, _ := s.NGetContext(context.Background(), key)
+	return keys
+}
+
+// NGetContext retrieves all keys except the specified key in order, returning ctx's error if it is done before the traversal completes
+func (s *ShardedBST) NGetContext(ctx context.Context, key []byte) ([]*Key, error) {
+	return s.query(ctx, 0, len(s.Shards)-1, func(bst *BST) ([]*Key, error) {
+		return bst.NGetContext(ctx, key)
+	})
+}
+
+// Close closes every shard
+func (s *ShardedBST) Close() {
+	for _, bst := range s.Shards {
+		bst.Close()
+	}
+}
+
+// query runs fn on the shards which may hold results in parallel and merges their ordered results.
+// With ShardRange only shards first to last are queried and their results are already in order.
+func (s *ShardedBST) query(ctx context.Context, first, last int, fn func(*BST) ([]*Key, error)) ([]*Key, error) {
+	shards := s.Shards
+	if s.Mode == ShardRange {
+		shards = shards[first : last+1]
+	}
+
+	results := make([][]*Key, len(shards))
+	errs := make([]error, len(shards))
+
+	var wg sync.WaitGroup
+	for i, bst := range shards {
+		wg.Add(1)
+		go func(i int, bst *BST) {
+			defer wg.Done()
+			results[i], errs[i] = fn(bst)
+		}(i, bst)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.Mode == ShardRange {
+		var keys []*Key
+		for _, result := range results {
+			keys = append(keys, result...)
+		}
+		return keys, nil
+	}
+	return mergeKeys(results), nil
+}
+
+// keyCursor is the next key of an ordered list being merged
+type keyCursor struct {
+	keys []*Key // Remaining keys of the list
+}
+
+// keyHeap orders lists being merged by their next key
+type keyHeap []keyCursor
+
+func (h keyHeap) Len() int           { return len(h) }
+func (h keyHeap) Less(i, j int) bool { return bytes.Compare(h[i].keys[0].K, h[j].keys[0].K) < 0 }
+func (h keyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *keyHeap) Push(x any)        { *h = append(*h, x.(keyCursor)) }
+func (h *keyHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// mergeKeys merges ordered lists of keys into a single ordered list with a k-way merge
+func mergeKeys(lists [][]*Key) []*Key {
+	n := 0
+	h := make(keyHeap, 0, len(lists))
+	for _, keys := range lists {
+		if len(keys) > 0 {
+			h = append(h, keyCursor{keys: keys})
+			n += len(keys)
+		}
+	}
+
+	if len(h) == 0 {
+		return nil
+	}
+	if len(h) == 1 {
+		return h[0].keys
+	}
+	heap.Init(&h)
+
+	merged := make([]*Key, 0, n)
+	for len(h) > 0 {
+		merged = append(merged, h[0].keys[0])
+		if h[0].keys = h[0].keys[1:]; len(h[0].keys) == 0 {
+			heap.Pop(&h)
+		} else {
+			heap.Fix(&h, 0)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,174 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// checkOrdered fails if keys are not the expected keys in order
+func checkOrdered(t *testing.T, keys []*Key, expect ...string) {
+	t.Helper()
+
+	if len(keys) != len(expect) {
+		t.Fatalf("expected %d keys, got %d", len(expect), len(keys))
+	}
+
+	for i, key := range keys {
+		if string(key.K) != expect[i] {
+			t.Fatalf("expected key %d to be %s, got %s", i, expect[i], key.K)
+		}
+	}
+}
+
+func TestShardedBST_Hash(t *testing.T) {
+	s := NewSharded(4)
+
+	defer func() {
+		s.Close()
+	}()
+
+	for i := 9; i >= 0; i-- {
+		s.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+
+	time.Sleep(10 * time.Millisecond) // wait for the tree to be built
+
+	// Keys are spread over more than one shard
+	used := 0
+	for _, bst := range s.Shards {
+		if len(bst.GreaterThanEq([]byte(""))) > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Fatalf("expected keys on several shards, got %d", used)
+	}
+
+	key := s.Get([]byte("key3"))
+	if key == nil || !bytes.Equal(key.Values[0], []byte("value3")) {
+		t.Fatalf("expected key3")
+	}
+
+	checkOrdered(t, s.Range([]byte("key2"), []byte("key5")), "key2", "key3", "key4", "key5")
+	checkOrdered(t, s.GreaterThan([]byte("key7")), "key8", "key9")
+	checkOrdered(t, s.GreaterThanEq([]byte("key7")), "key7", "key8", "key9")
+	checkOrdered(t, s.LessThan([]byte("key2")), "key0", "key1")
+	checkOrdered(t, s.LessThanEq([]byte("key2")), "key0", "key1", "key2")
+	checkOrdered(t, s.NGet([]byte("key5")), "key0", "key1", "key2", "key3", "key4", "key6", "key7", "key8", "key9")
+
+	if !s.Delete([]byte("key3")) || s.Get([]byte("key3")) != nil {
+		t.Fatalf("expected key3 to be deleted")
+	}
+}
+
+func TestShardedBST_Metrics(t *testing.T) {
+	registry := NewRegistry()
+	s := NewSharded(4, WithMetrics(registry))
+
+	defer func() {
+		s.Close()
+	}()
+
+	for i := 0; i < 100; i++ {
+		s.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("value"))
+	}
+
+	time.Sleep(10 * time.Millisecond) // wait for the tree to be built
+
+	// Gauges are summed across the shards rather than overwritten by each
+	if registry.Gauge(MetricNodes) != 100 {
+		t.Fatalf("expected 100 nodes across the shards, got %d", registry.Gauge(MetricNodes))
+	}
+
+	if registry.Gauge(MetricQueueDepth) != 0 {
+		t.Fatalf("expected an empty write queue across the shards, got %d", registry.Gauge(MetricQueueDepth))
+	}
+
+	if registry.Counter(MetricPuts) != 100 {
+		t.Fatalf("expected 100 puts, got %d", registry.Counter(MetricPuts))
+	}
+
+	for i := 0; i < 10; i++ {
+		s.Delete([]byte(fmt.Sprintf("key%02d", i)))
+	}
+
+	if registry.Gauge(MetricNodes) != 90 {
+		t.Fatalf("expected 90 nodes across the shards, got %d", registry.Gauge(MetricNodes))
+	}
+}
+
+func TestShardedBST_Range(t *testing.T) {
+	s := NewRangeSharded([][]byte{[]byte("m"), []byte("f"), []byte("m")})
+
+	defer func() {
+		s.Close()
+	}()
+
+	if len(s.Shards) != 3 {
+		t.Fatalf("expected 3 shards, got %d", len(s.Shards))
+	}
+
+	for _, k := range []string{"z", "a", "m", "g", "f", "b", "q"} {
+		s.PutOffQueue([]byte(k), []byte(k))
+	}
+
+	// Keys are split by range
+	checkOrdered(t, s.Shards[0].GreaterThanEq([]byte("")), "a", "b")
+	checkOrdered(t, s.Shards[1].GreaterThanEq([]byte("")), "f", "g")
+	checkOrdered(t, s.Shards[2].GreaterThanEq([]byte("")), "m", "q", "z")
+
+	checkOrdered(t, s.Range([]byte("b"), []byte("q")), "b", "f", "g", "m", "q")
+	checkOrdered(t, s.GreaterThan([]byte("g")), "m", "q", "z")
+	checkOrdered(t, s.LessThanEq([]byte("f")), "a", "b", "f")
+	checkOrdered(t, s.NGet([]byte("m")), "a", "b", "f", "g", "q", "z")
+}
+
+func TestMergeKeys(t *testing.T) {
+	lists := [][]*Key{
+		{newKey([]byte("a")), newKey([]byte("d")), newKey([]byte("g"))},
+		nil,
+		{newKey([]byte("b")), newKey([]byte("e"))},
+		{newKey([]byte("c")), newKey([]byte("f")), newKey([]byte("h"))},
+	}
+
+	checkOrdered(t, mergeKeys(lists), "a", "b", "c", "d", "e", "f", "g", "h")
+
+	if mergeKeys(nil) != nil {
+		t.Fatalf("expected no keys")
+	}
+}
+
+func BenchmarkShardedBST_Put(b *testing.B) {
+	for _, n := range []int{1, 4} {
+		b.Run(fmt.Sprintf("shards=%d", n), func(b *testing.B) {
+			s := NewSharded(n)
+			defer s.Close()
+
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					s.PutOffQueue([]byte(fmt.Sprintf("key%d", i)), []byte("value"))
+					i++
+				}
+			})
+		})
+	}
+}
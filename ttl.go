@@ -0,0 +1,154 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultReapInterval is the default interval between sweeps for expired values
+const DefaultReapInterval = time.Second
+
+// MetricExpired counts values removed by the reaper after expiring
+const MetricExpired = "bst_expired_total"
+
+// WithReapInterval sets the interval between sweeps for expired values, 0 disables the reaper
+func WithReapInterval(d time.Duration) Option {
+	return func(bst *BST) {
+		bst.ReapInterval = d
+	}
+}
+
+// PutWithTTL adds a value to a key which expires after ttl.  A ttl of 0 or less never expires.
+func (bst *BST) PutWithTTL(key, value []byte, ttl time.Duration) {
+	bst.putWithTTL(context.Background(), key, value, ttl)
+}
+
+// putWithTTL queues a value which expires after ttl, returning an error if it could not be queued
+func (bst *BST) putWithTTL(ctx context.Context, key, value []byte, ttl time.Duration) error {
+	var expires int64
+	if ttl > 0 {
+		atomic.StoreInt32(&bst.ttl, 1)
+		expires = time.Now().Add(ttl).UnixNano()
+	}
+	return bst.enqueue(ctx, bst.putOperation(OpPut, key, value, expires))
+}
+
+// live returns the state without its expired values.  The state itself is returned if nothing expired,
+// a copy if some values expired and nil if all of them did.
+func (s *keyState) live(now int64) *keyState {
+	if s.expires == nil {
+		return s
+	}
+
+	n := 0
+	for i := 0; i < s.len(); i++ {
+		if !s.expired(i, now) {
+			n++
+		}
+	}
+
+	switch n {
+	case s.len():
+		return s
+	case 0:
+		return nil
+	}
+
+	live := &keyState{key: s.key, table: s.table}
+	for i := 0; i < s.len(); i++ {
+		if !s.expired(i, now) {
+			live.copyFrom(s, i, i+1)
+		}
+	}
+	return live
+}
+
+// liveValues returns the values which have not expired at now
+func (s *keyState) liveValues(now int64) [][]byte {
+	if live := s.live(now); live != nil {
+		return live.list()
+	}
+	return nil
+}
+
+// backgroundReaper periodically removes expired values until the tree is closed
+func (bst *BST) backgroundReaper() {
+	ticker := time.NewTicker(bst.ReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-bst.Exit:
+			return
+		case <-ticker.C:
+			if atomic.LoadInt32(&bst.ttl) == 1 {
+				bst.reap(time.Now().UnixNano())
+			}
+		}
+	}
+}
+
+// reap removes values expired at now, deleting keys left without values
+func (bst *BST) reap(now int64) {
+	var empty [][]byte
+	var events []Event
+
+	e := bst.pin()
+	bst.walk((*Node)(atomic.LoadPointer(&bst.Root)), func(key *Key) bool {
+		key.Latch.Lock()
+		defer key.Latch.Unlock()
+
+		s := key.load()
+		live := s.live(now)
+		if live == s {
+			return true
+		}
+		if live == nil {
+			live = key.next()
+		}
+
+		for i := 0; i < s.len(); i++ {
+			if s.expired(i, now) {
+				events = append(events, Event{Type: EventRemove, Key: key.bytes(), Value: bst.decode(s.value(i))})
+			}
+		}
+
+		size := key.size
+		key.publish(live)
+		bst.incr(MetricExpired, int64(s.len()-live.len()))
+		bst.account(key.size - size)
+		if live.len() == 0 {
+			empty = append(empty, key.bytes())
+		}
+		return true
+	})
+	bst.unpin(e)
+
+	for _, ev := range events {
+		bst.notify(ev)
+	}
+
+	// Only delete keys which are still empty, a value may have been put since
+	for _, k := range empty {
+		bst.deleteKey(k, func(key *Key) bool {
+			return key.load().len() == 0
+		})
+	}
+}
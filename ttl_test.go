@@ -0,0 +1,129 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBST_PutWithTTL(t *testing.T) {
+	bst := New(WithReapInterval(0))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.Put([]byte("key"), []byte("value"))
+	bst.PutWithTTL([]byte("key"), []byte("value ttl"), 50*time.Millisecond)
+	bst.PutWithTTL([]byte("key2"), []byte("value ttl"), 50*time.Millisecond)
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	key := bst.Get([]byte("key"))
+	if key == nil || len(key.Values) != 2 {
+		t.Fatal("expected key with 2 values")
+	}
+
+	if len(bst.Range([]byte("key"), []byte("key2"))) != 2 {
+		t.Fatal("expected 2 keys in range")
+	}
+
+	// wait for the values to expire
+	time.Sleep(50 * time.Millisecond)
+
+	key = bst.Get([]byte("key"))
+	if key == nil || len(key.Values) != 1 || string(key.Values[0]) != "value" {
+		t.Fatal("expected key with only the value without a ttl")
+	}
+
+	if bst.Get([]byte("key2")) != nil {
+		t.Fatal("expected key2 to have expired")
+	}
+
+	keys := bst.GreaterThanEq([]byte("key"))
+	if len(keys) != 1 || string(keys[0].K) != "key" {
+		t.Fatal("expected only key in range")
+	}
+}
+
+func TestBST_Reaper(t *testing.T) {
+	registry := NewRegistry()
+	bst := New(WithReapInterval(5*time.Millisecond), WithMetrics(registry))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.Put([]byte("key"), []byte("value"))
+	bst.PutWithTTL([]byte("key"), []byte("value ttl"), 10*time.Millisecond)
+	bst.PutWithTTL([]byte("key2"), []byte("value ttl"), 10*time.Millisecond)
+
+	// wait for the values to expire and be reaped
+	time.Sleep(50 * time.Millisecond)
+
+	// Check the nodes themselves rather than the filtered results
+	root := (*Node)(atomic.LoadPointer(&bst.Root))
+	if bst.get(root, []byte("key2")) != nil {
+		t.Fatal("expected key2 to have been deleted")
+	}
+
+	key := bst.get(root, []byte("key"))
+	if key == nil || len(key.load().values) != 1 || len(key.load().expires) != 1 {
+		t.Fatal("expected expired value to have been removed")
+	}
+
+	if registry.Counter(MetricExpired) != 2 {
+		t.Fatalf("expected 2 expired values, got %d", registry.Counter(MetricExpired))
+	}
+}
+
+func TestBST_ReaperEvents(t *testing.T) {
+	bst := New(WithReapInterval(5 * time.Millisecond))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := bst.Watch(ctx, []byte("key"), []byte("key"))
+
+	bst.Put([]byte("key"), []byte("value"))
+	bst.PutWithTTL([]byte("key"), []byte("value ttl"), 10*time.Millisecond)
+
+	expect := []Event{
+		{Type: EventPut, Key: []byte("key"), Value: []byte("value")},
+		{Type: EventPut, Key: []byte("key"), Value: []byte("value ttl")},
+		{Type: EventRemove, Key: []byte("key"), Value: []byte("value ttl")},
+	}
+
+	for _, e := range expect {
+		select {
+		case ev := <-events:
+			if ev.Type != e.Type || string(ev.Key) != string(e.Key) || string(ev.Value) != string(e.Value) {
+				t.Fatalf("expected %v, got %v", e, ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bytes"
+	"sort"
+	"time"
+)
+
+// ValueMode is how the values of a key are stored
+type ValueMode int
+
+const (
+	ValueList      ValueMode = iota // Values are appended in insertion order, duplicates included
+	ValueSet                        // Values are kept in insertion order without duplicates
+	ValueSortedSet                  // Values are kept in sorted order without duplicates
+	ValueMap                        // A key holds a single value which puts overwrite, a plain key to value map
+)
+
+// WithValueMode sets how the values of a key are stored
+func WithValueMode(mode ValueMode) Option {
+	return func(bst *BST) {
+		bst.ValueMode = mode
+	}
+}
+
+// insertValue adds a value according to mode.  Putting a value already within a set
+// only updates its expiry.  The key latch must be held.
+func (k *Key) insertValue(value []byte, expires int64, mode ValueMode) {
+	switch mode {
+	case ValueMap:
+		k.replaceValue(value, expires)
+		return
+	case ValueSet:
+		if i := k.indexOf(value, mode); i >= 0 {
+			k.setExpiry(i, expires)
+			return
+		}
+	case ValueSortedSet:
+		s := k.load()
+		i := sort.Search(s.len(), func(i int) bool {
+			return bytes.Compare(s.value(i), value) >= 0
+		})
+
+		if i < s.len() && bytes.Equal(s.value(i), value) {
+			k.setExpiry(i, expires)
+			return
+		}
+
+		// Copy the values around the new one, the published lists can not be shifted
+		n := k.next()
+		n.copyFrom(s, 0, i)
+		n.add(value, expires)
+		n.copyFrom(s, i, s.len())
+		k.publish(n)
+		return
+	}
+
+	k.appendValue(value, expires)
+}
+
+// replaceValue replaces all values with value.  The key latch must be held.
+func (k *Key) replaceValue(value []byte, expires int64) {
+	n := k.next()
+	n.add(value, expires)
+	k.publish(n)
+}
+
+// setValues replaces all values and their expiries, nil if none expire.  The key latch must be held.
+func (k *Key) setValues(values [][]byte, expires []int64) {
+	n := k.next()
+	for i, v := range values {
+		var e int64
+		if expires != nil {
+			e = expires[i]
+		}
+		n.add(v, e)
+	}
+	k.publish(n)
+}
+
+// normalize returns values as a key in mode holds them, without duplicates in a set, sorted in a
+// sorted set and only the last value in a map.  values itself is not changed.
+func normalize(values [][]byte, mode ValueMode) [][]byte {
+	switch mode {
+	case ValueSet:
+		set := make([][]byte, 0, len(values))
+		for _, v := range values {
+			if indexOfValue(set, v) < 0 {
+				set = append(set, v)
+			}
+		}
+		return set
+	case ValueSortedSet:
+		sorted := append([][]byte(nil), values...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return bytes.Compare(sorted[i], sorted[j]) < 0
+		})
+
+		set := sorted[:0]
+		for _, v := range sorted {
+			if len(set) == 0 || !bytes.Equal(set[len(set)-1], v) {
+				set = append(set, v)
+			}
+		}
+		return set
+	case ValueMap:
+		if len(values) > 1 {
+			return values[len(values)-1:]
+		}
+	}
+	return values
+}
+
+// indexOfValue returns the index of the first copy of value within values, -1 if not found
+func indexOfValue(values [][]byte, value []byte) int {
+	for i, v := range values {
+		if bytes.Equal(v, value) {
+			return i
+		}
+	}
+	return -1
+}
+
+// indexOf returns the index of the first copy of value, -1 if not found.  The key latch must be held.
+func (k *Key) indexOf(value []byte, mode ValueMode) int {
+	s := k.load()
+	if mode == ValueSortedSet {
+		i := sort.Search(s.len(), func(i int) bool {
+			return bytes.Compare(s.value(i), value) >= 0
+		})
+
+		if i < s.len() && bytes.Equal(s.value(i), value) {
+			return i
+		}
+		return -1
+	}
+
+	for i := 0; i < s.len(); i++ {
+		if bytes.Equal(s.value(i), value) {
+			return i
+		}
+	}
+	return -1
+}
+
+// setExpiry sets the expiry of the value at index i.  The key latch must be held.
+func (k *Key) setExpiry(i int, expires int64) {
+	s := k.load()
+	if s.expiry(i) == expires {
+		return
+	}
+
+	n := k.next()
+	n.copyFrom(s, 0, i)
+	n.add(s.value(i), expires)
+	n.copyFrom(s, i+1, s.len())
+	k.publish(n)
+}
+
+// Set replaces the values of a key with a single value, last writer wins.  It is queued behind
+// earlier writes to the key and waits for them, returning the previous value, the first value if
+// the key held several, and whether there was a previous value.
+func (bst *BST) Set(key, value []byte) ([]byte, bool) {
+	op := &Operation{Type: OpSet, Key: key, Value: value}
+	if bst.applyQueued(op) != nil {
+		return nil, false
+	}
+	return op.prev, op.ok
+}
+
+// setOffQueue replaces the values of a key with a single value
+func (bst *BST) setOffQueue(key, value []byte) ([]byte, bool) {
+	defer bst.notify(Event{Type: EventPut, Key: key, Value: value})
+	defer bst.observe(MetricPutDuration, time.Now())
+	bst.incr(MetricPuts, 1)
+
+	var prev []byte
+	var existed bool
+
+	stored := bst.keepValue(value)
+	bst.upsert(key, func() *Key {
+		k := bst.newKey(bst.keep(key))
+		k.appendValue(stored, 0)
+		return k
+	}, func(existing *Key) {
+		if s := existing.load(); s.len() > 0 && !s.expired(0, time.Now().UnixNano()) {
+			prev, existed = bst.decode(s.value(0)), true
+		}
+		existing.replaceValue(stored, 0)
+	})
+
+	return prev, existed
+}
@@ -0,0 +1,160 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBST_ValueSet(t *testing.T) {
+	bst := New(WithValueMode(ValueSet))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	for _, v := range []string{"b", "a", "b", "c", "a"} {
+		bst.Put([]byte("key"), []byte(v))
+	}
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	key := bst.Get([]byte("key"))
+	expect := []string{"b", "a", "c"}
+	if len(key.Values) != len(expect) {
+		t.Fatalf("expected %d values, got %d", len(expect), len(key.Values))
+	}
+
+	for i, v := range expect {
+		if string(key.Values[i]) != v {
+			t.Fatalf("expected %s, got %s", v, key.Values[i])
+		}
+	}
+
+	bst.Remove([]byte("key"), []byte("b"))
+
+	key = bst.Get([]byte("key"))
+	if len(key.Values) != 2 || string(key.Values[0]) != "a" {
+		t.Fatal("expected b to be removed")
+	}
+}
+
+func TestBST_ValueSortedSet(t *testing.T) {
+	bst := New(WithValueMode(ValueSortedSet))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	for _, v := range []string{"d", "b", "a", "d", "c", "b"} {
+		bst.Put([]byte("key"), []byte(v))
+	}
+	bst.PutWithTTL([]byte("key"), []byte("bb"), time.Hour)
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	key := bst.Get([]byte("key"))
+	expect := []string{"a", "b", "bb", "c", "d"}
+	if len(key.Values) != len(expect) {
+		t.Fatalf("expected %d values, got %d", len(expect), len(key.Values))
+	}
+
+	for i, v := range expect {
+		if string(key.Values[i]) != v {
+			t.Fatalf("expected %s, got %s", v, key.Values[i])
+		}
+	}
+
+	// Expiries move with their values
+	if key.Expires[2] == 0 || key.Expires[1] != 0 || key.Expires[3] != 0 {
+		t.Fatal("expected only bb to expire")
+	}
+
+	bst.Remove([]byte("key"), []byte("bb"))
+	bst.Remove([]byte("key"), []byte("a"))
+
+	keys := bst.Range([]byte("key"), []byte("key"))
+	if len(keys) != 1 || len(keys[0].Values) != 3 || string(keys[0].Values[0]) != "b" {
+		t.Fatal("expected b, c and d to remain")
+	}
+
+	if len(keys[0].Expires) != 3 || keys[0].Expires[0] != 0 {
+		t.Fatal("expected expiries to be removed with their values")
+	}
+}
+
+func TestBST_ValueMap(t *testing.T) {
+	bst := New(WithValueMode(ValueMap))
+
+	defer func() {
+		bst.Close()
+	}()
+
+	bst.Put([]byte("key"), []byte("value"))
+	bst.Put([]byte("key"), []byte("value 2"))
+	bst.Put([]byte("key2"), []byte("value"))
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	key := bst.Get([]byte("key"))
+	if len(key.Values) != 1 || string(key.Values[0]) != "value 2" {
+		t.Fatal("expected the second put to overwrite the first")
+	}
+
+	bst.PutWithTTL([]byte("key2"), []byte("value 2"), time.Hour)
+	time.Sleep(10 * time.Millisecond)
+
+	key = bst.Get([]byte("key2"))
+	if len(key.Values) != 1 || len(key.Expires) != 1 || key.Expires[0] == 0 {
+		t.Fatal("expected a single value with an expiry")
+	}
+}
+
+func TestBST_Set(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	prev, ok := bst.Set([]byte("key"), []byte("value"))
+	if ok || prev != nil {
+		t.Fatal("expected no previous value")
+	}
+
+	prev, ok = bst.Set([]byte("key"), []byte("value 2"))
+	if !ok || string(prev) != "value" {
+		t.Fatalf("expected previous value to be value, got %s", prev)
+	}
+
+	bst.Put([]byte("key"), []byte("value 3"))
+	time.Sleep(10 * time.Millisecond)
+
+	prev, ok = bst.Set([]byte("key"), []byte("value 4"))
+	if !ok || string(prev) != "value 2" {
+		t.Fatalf("expected previous value to be value 2, got %s", prev)
+	}
+
+	key := bst.Get([]byte("key"))
+	if len(key.Values) != 1 || string(key.Values[0]) != "value 4" {
+		t.Fatal("expected Set to replace all values")
+	}
+}
@@ -0,0 +1,166 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+)
+
+// DefaultWatchBuffer is the default number of events buffered per subscriber
+const DefaultWatchBuffer = 64
+
+// EventType is the type of change to the tree
+type EventType int
+
+const (
+	EventPut    EventType = iota // A value was put to a key
+	EventRemove                  // A value was removed from a key
+	EventDelete                  // A key was deleted
+	EventMerge                   // An operand was merged into a key's values
+)
+
+// Event is a change applied to the tree
+type Event struct {
+	Type   EventType // Type of change
+	Key    []byte    // Key that changed, a copy the subscriber may change unless the tree has BorrowedReads
+	Value  []byte    // Value put or removed or operand merged, nil for deletes, copied as Key
+	Missed int64     // Events dropped for this subscriber since its previous event
+}
+
+// WatchOption configures a subscription on Watch
+type WatchOption func(*watcher)
+
+// WithWatchBuffer sets the number of events buffered for the subscriber
+func WithWatchBuffer(n int) WatchOption {
+	return func(w *watcher) {
+		w.buffer = n
+	}
+}
+
+// WithBackpressure blocks mutations while the subscriber's buffer is full instead of dropping events
+func WithBackpressure() WatchOption {
+	return func(w *watcher) {
+		w.block = true
+	}
+}
+
+// watcher is a change feed subscriber
+type watcher struct {
+	start, end []byte          // Inclusive key range, a nil end has no upper bound
+	events     chan Event      // Delivered events
+	buffer     int             // Size of the events buffer
+	block      bool            // Block when the buffer is full rather than drop
+	missed     int64           // Events dropped since the last delivered event
+	done       <-chan struct{} // Closed when the subscription is cancelled
+}
+
+// Watch subscribes to changes of keys between start and end inclusive, a nil end has no upper bound.
+// Events are sent after each put, value removal and key deletion is applied.  By default events
+// are dropped while the buffer is full and the number dropped is reported on the next event's Missed,
+// see WithBackpressure.  The channel is closed when ctx is done or the tree is closed.
+func (bst *BST) Watch(ctx context.Context, start, end []byte, opts ...WatchOption) <-chan Event {
+	w := &watcher{start: start, end: end, buffer: DefaultWatchBuffer, done: ctx.Done()}
+	for _, opt := range opts {
+		opt(w)
+	}
+	w.events = make(chan Event, w.buffer)
+
+	bst.watchLock.Lock()
+	bst.watchers = append(bst.watchers, w)
+	bst.watchLock.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-bst.Exit:
+		}
+		bst.unwatch(w)
+	}()
+
+	return w.events
+}
+
+// unwatch removes a subscriber and closes its channel
+func (bst *BST) unwatch(w *watcher) {
+	bst.watchLock.Lock()
+	defer bst.watchLock.Unlock()
+
+	for i, other := range bst.watchers {
+		if other == w {
+			bst.watchers = append(bst.watchers[:i], bst.watchers[i+1:]...)
+			break
+		}
+	}
+
+	// Senders hold the read lock so none can be sending now
+	close(w.events)
+}
+
+// notify sends an event to every subscriber watching its key.  Each subscriber receives its own copy of
+// the key and value, which may be the tree's own, unless the tree has BorrowedReads.
+func (bst *BST) notify(ev Event) {
+	bst.watchLock.RLock()
+	defer bst.watchLock.RUnlock()
+
+	for _, w := range bst.watchers {
+		if bytes.Compare(ev.Key, w.start) < 0 || (w.end != nil && bytes.Compare(ev.Key, w.end) > 0) {
+			continue
+		}
+
+		if bst.BorrowedReads {
+			w.send(ev, bst.Exit)
+		} else {
+			w.send(copyEvent(ev), bst.Exit)
+		}
+	}
+}
+
+// copyEvent returns ev with its key and value copied into a single buffer
+func copyEvent(ev Event) Event {
+	buf := make([]byte, 0, len(ev.Key)+len(ev.Value))
+	buf = append(buf, ev.Key...)
+	buf = append(buf, ev.Value...)
+
+	n := len(ev.Key)
+	ev.Key = buf[:n:n]
+	if ev.Value != nil {
+		ev.Value = buf[n:len(buf):len(buf)]
+	}
+	return ev
+}
+
+// send delivers an event, blocking or dropping if the buffer is full
+func (w *watcher) send(ev Event, exit <-chan struct{}) {
+	ev.Missed = atomic.SwapInt64(&w.missed, 0)
+
+	if w.block {
+		select {
+		case w.events <- ev:
+		case <-w.done:
+		case <-exit:
+		}
+		return
+	}
+
+	select {
+	case w.events <- ev:
+	default:
+		atomic.AddInt64(&w.missed, ev.Missed+1)
+	}
+}
@@ -0,0 +1,168 @@
+// Package bst
+// A concurrent safe, lockless binary search tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package bst
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBST_Watch(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := bst.Watch(ctx, []byte("key1"), []byte("key2"))
+
+	bst.Put([]byte("key0"), []byte("value"))
+	bst.Put([]byte("key1"), []byte("value"))
+	bst.Put([]byte("key1"), []byte("value 2"))
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	bst.Remove([]byte("key1"), []byte("value"))
+	bst.Remove([]byte("key1"), []byte("value 3")) // not found, no event
+	bst.Delete([]byte("key1"))
+	bst.Delete([]byte("key0"))
+
+	expect := []Event{
+		{Type: EventPut, Key: []byte("key1"), Value: []byte("value")},
+		{Type: EventPut, Key: []byte("key1"), Value: []byte("value 2")},
+		{Type: EventRemove, Key: []byte("key1"), Value: []byte("value")},
+		{Type: EventDelete, Key: []byte("key1")},
+	}
+
+	for _, e := range expect {
+		select {
+		case ev := <-events:
+			if ev.Type != e.Type || string(ev.Key) != string(e.Key) || string(ev.Value) != string(e.Value) {
+				t.Fatalf("expected %v, got %v", e, ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+	}
+
+	cancel()
+
+	// The channel is closed once the subscription is cancelled
+	for range events {
+		t.Fatal("unexpected event")
+	}
+}
+
+func TestBST_WatchDrop(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := bst.Watch(ctx, []byte("key"), nil, WithWatchBuffer(1))
+
+	bst.Put([]byte("key1"), []byte("value"))
+	bst.Put([]byte("key2"), []byte("value"))
+	bst.Put([]byte("key3"), []byte("value"))
+
+	// wait for the tree to be built
+	time.Sleep(10 * time.Millisecond)
+
+	ev := <-events
+	if string(ev.Key) != "key1" || ev.Missed != 0 {
+		t.Fatalf("unexpected event %v", ev)
+	}
+
+	bst.Put([]byte("key4"), []byte("value"))
+	time.Sleep(10 * time.Millisecond)
+
+	ev = <-events
+	if string(ev.Key) != "key4" || ev.Missed != 2 {
+		t.Fatalf("expected key4 with 2 missed events, got %v", ev)
+	}
+}
+
+func TestBST_WatchBackpressure(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := bst.Watch(ctx, nil, nil, WithWatchBuffer(1), WithBackpressure())
+
+	for i := 0; i < 5; i++ {
+		bst.Put([]byte{byte('a' + i)}, []byte("value"))
+	}
+
+	for i := 0; i < 5; i++ {
+		select {
+		case ev := <-events:
+			if ev.Key[0] != byte('a'+i) || ev.Missed != 0 {
+				t.Fatalf("unexpected event %v", ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+	}
+}
+
+func TestBST_WatchCopies(t *testing.T) {
+	bst := New()
+
+	defer func() {
+		bst.Close()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := bst.Watch(ctx, nil, nil)
+
+	bst.Put([]byte("key"), []byte("value"))
+
+	select {
+	case ev := <-events:
+		// Changing the event must not change the tree
+		ev.Key[0] = 'z'
+		ev.Value[0] = 'X'
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	key := bst.Get([]byte("key"))
+	if key == nil || string(key.Values[0]) != "value" {
+		t.Fatal("expected the tree to be unchanged by the subscriber")
+	}
+
+	keys := bst.Range([]byte("a"), []byte("z"))
+	if len(keys) != 1 || string(keys[0].K) != "key" {
+		t.Fatal("expected the tree's key to be unchanged by the subscriber")
+	}
+}